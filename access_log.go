@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"proxy-bench/muxnet"
+	"proxy-bench/netx"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// streamRecord is the access log entry of one relayed stream. Downstream is
+// the accepted stream, upstream the opened one.
+type streamRecord struct {
+	ID             uint64    `json:"id"`
+	ListenScheme   string    `json:"listen_scheme"`
+	ConnectScheme  string    `json:"connect_scheme"`
+	DownRemoteAddr string    `json:"down_remote_addr,omitempty"`
+	DownLocalAddr  string    `json:"down_local_addr,omitempty"`
+	UpLocalAddr    string    `json:"up_local_addr,omitempty"`
+	UpRemoteAddr   string    `json:"up_remote_addr,omitempty"`
+	Start          time.Time `json:"start"`
+	DurationMS     float64   `json:"duration_ms"`
+	BytesUp        int64     `json:"bytes_up"`
+	BytesDown      int64     `json:"bytes_down"`
+	// TTFBMS is the time until the first byte from upstream was relayed,
+	// absent if none was.
+	TTFBMS *float64 `json:"ttfb_ms,omitempty"`
+	// AdmissionWaitMS is how long the stream waited for admission after being
+	// accepted, absent for schemes which admit streams before accepting them.
+	// Start, DurationMS and TTFBMS begin after it.
+	AdmissionWaitMS *float64 `json:"admission_wait_ms,omitempty"`
+	// CloseReason is how the side which finished first ended: eof, reset,
+	// idle_timeout or error. open_failed if there never was an upstream.
+	CloseReason string `json:"close_reason"`
+	FirstClosed string `json:"first_closed,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+var lastStreamID atomic.Uint64
+
+func newStreamRecord(listenScheme, connectScheme string, down netx.Stream) *streamRecord {
+	record := &streamRecord{
+		ID:            lastStreamID.Add(1),
+		ListenScheme:  listenScheme,
+		ConnectScheme: connectScheme,
+		Start:         time.Now(),
+	}
+	record.DownLocalAddr, record.DownRemoteAddr = streamAddrs(down)
+	return record
+}
+
+func streamAddrs(stream netx.Stream) (local, remote string) {
+	addressed, ok := stream.(netx.Addressed)
+	if !ok {
+		return "", ""
+	}
+
+	if addr := addressed.LocalAddr(); addr != nil {
+		local = addr.String()
+	}
+	if addr := addressed.RemoteAddr(); addr != nil {
+		remote = addr.String()
+	}
+	return local, remote
+}
+
+// admitted records the wait for admission since accepted and restarts the
+// stream's clock.
+func (r *streamRecord) admitted() {
+	wait := milliseconds(time.Since(r.Start))
+	r.AdmissionWaitMS = &wait
+	r.Start = time.Now()
+}
+
+// setClosed records how the first direction to finish ended.
+func (r *streamRecord) setClosed(side string, err error) {
+	r.FirstClosed = side
+	r.CloseReason = closeReason(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func closeReason(err error) string {
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, muxnet.ErrStreamReset):
+		return "reset"
+	case errors.Is(err, errIdleTimeout):
+		return "idle_timeout"
+	default:
+		return "error"
+	}
+}
+
+func (r *streamRecord) finish(up, down *countingStream) {
+	r.DurationMS = milliseconds(time.Since(r.Start))
+	if up != nil {
+		r.BytesUp = up.written.Load()
+	}
+	if down != nil {
+		r.BytesDown = down.written.Load()
+		if first := down.firstWrite.Load(); first != 0 {
+			ttfb := milliseconds(time.Unix(0, first).Sub(r.Start))
+			r.TTFBMS = &ttfb
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// accessLog writes one JSON line per stream. A nil accessLog discards them.
+type accessLog struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+var streamLog *accessLog
+
+func openAccessLog(path string) (*accessLog, error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+
+	return &accessLog{
+		encoder: json.NewEncoder(w),
+	}, nil
+}
+
+func (l *accessLog) write(record *streamRecord) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.encoder.Encode(record)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"proxy-bench/admission"
+	"proxy-bench/metrics"
+	"proxy-bench/netx"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// admissionSchemes are the schemes which admit streams before accepting
+// them, so a rejection reaches the opener as an error of its OpenStream call.
+// Streams of other schemes are admitted after being accepted and closed if
+// rejected. Set by the creators.
+var admissionSchemes = make(map[string]bool)
+
+func getAdmissionSchemes() string {
+	return joinSchemes(admissionSchemes)
+}
+
+// newAdmission caps the streams relayed at once, in total and per remote
+// host, zero is unlimited. Streams over the caps wait up to timeout in a
+// queue of queue streams. It returns nil if there are no caps.
+func newAdmission(maxStreams, maxPerRemote, queue int, timeout time.Duration) (netx.Admission, error) {
+	if maxStreams < 0 || maxPerRemote < 0 || queue < 0 {
+		return nil, fmt.Errorf("stream limits and queue must not be negative")
+	}
+	if maxStreams == 0 && maxPerRemote == 0 {
+		return nil, nil
+	}
+
+	controller := admission.New(admission.Config{
+		MaxStreams:   maxStreams,
+		MaxPerRemote: maxPerRemote,
+		MaxQueued:    queue,
+		Timeout:      timeout,
+	})
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_admission_queued",
+		Help: "Streams of the listen side waiting to be admitted.",
+	}, func() float64 {
+		return float64(controller.Queued())
+	}))
+
+	return func(ctx context.Context, remote net.Addr) (func(), error) {
+		release, err := controller.Admit(ctx, remoteHost(remote))
+		if err != nil {
+			reason := "canceled"
+			switch {
+			case errors.Is(err, admission.ErrQueueFull):
+				reason = "queue_full"
+			case errors.Is(err, admission.ErrTimeout):
+				reason = "timeout"
+			}
+			metrics.AdmissionRejected.WithLabelValues(reason).Inc()
+			return nil, fmt.Errorf("%w: %w", netx.ErrOverloaded, err)
+		}
+
+		return release, nil
+	}, nil
+}
+
+// remoteHost is what streams are limited per remote by, the host without the
+// port, since clients of transports with a connection per stream use a new
+// port for every one.
+func remoteHost(remote net.Addr) string {
+	if remote == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return remote.String()
+	}
+
+	return host
+}
+
+// admitStream admits a stream accepted by a scheme which doesn't do it itself,
+// closing it if rejected.
+func admitStream(admit netx.Admission, down netx.Stream, id uint64) (release func(), ok bool) {
+	var remote net.Addr
+	if addressed, ok := down.(netx.Addressed); ok {
+		remote = addressed.RemoteAddr()
+	}
+
+	release, err := admit.Admit(context.Background(), remote)
+	if err != nil {
+		logger.Debug().Err(err).Uint64("stream", id).Msg("Rejected stream")
+		down.Close()
+		return nil, false
+	}
+
+	return release, true
+}
@@ -0,0 +1,143 @@
+// Package admission caps concurrent streams, globally and per remote, and
+// queues those over the cap for a while before rejecting them.
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("admission queue full")
+	ErrTimeout   = errors.New("timed out in admission queue")
+)
+
+type Config struct {
+	// MaxStreams is how many streams may be admitted at once, zero is
+	// unlimited.
+	MaxStreams int
+	// MaxPerRemote is how many of them may come from one remote, zero is
+	// unlimited.
+	MaxPerRemote int
+	// MaxQueued is how many streams may wait for a slot, others are
+	// rejected right away.
+	MaxQueued int
+	// Timeout is how long a stream waits for a slot.
+	Timeout time.Duration
+}
+
+// Controller admits streams within the limits of its Config. Queued streams
+// are woken whenever a slot is given back and admitted in no particular
+// order, so one remote at its own limit doesn't hold up the others.
+type Controller struct {
+	config Config
+
+	mu      sync.Mutex
+	active  int
+	remotes map[string]int
+	queued  int
+	// freed is closed and replaced whenever a slot is given back.
+	freed chan struct{}
+}
+
+func New(config Config) *Controller {
+	return &Controller{
+		config:  config,
+		remotes: make(map[string]int),
+		freed:   make(chan struct{}),
+	}
+}
+
+// Admit waits until a stream from remote fits, an empty remote only counts
+// against MaxStreams. release must be called once the stream is done.
+func (c *Controller) Admit(ctx context.Context, remote string) (release func(), err error) {
+	var timeout <-chan time.Time
+	for {
+		c.mu.Lock()
+		if c.fits(remote) {
+			c.active++
+			if remote != "" {
+				c.remotes[remote]++
+			}
+			c.mu.Unlock()
+
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					c.release(remote)
+				})
+			}, nil
+		}
+
+		if timeout == nil {
+			if c.queued >= c.config.MaxQueued {
+				c.mu.Unlock()
+				return nil, ErrQueueFull
+			}
+
+			c.queued++
+			defer c.dequeue()
+			timer := time.NewTimer(c.config.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		freed := c.freed
+		c.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Controller) fits(remote string) bool {
+	if c.config.MaxStreams != 0 && c.active >= c.config.MaxStreams {
+		return false
+	}
+
+	return remote == "" || c.config.MaxPerRemote == 0 || c.remotes[remote] < c.config.MaxPerRemote
+}
+
+func (c *Controller) release(remote string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active--
+	if remote != "" {
+		c.remotes[remote]--
+		if c.remotes[remote] == 0 {
+			delete(c.remotes, remote)
+		}
+	}
+
+	close(c.freed)
+	c.freed = make(chan struct{})
+}
+
+func (c *Controller) dequeue() {
+	c.mu.Lock()
+	c.queued--
+	c.mu.Unlock()
+}
+
+// Active returns how many streams are admitted.
+func (c *Controller) Active() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.active
+}
+
+// Queued returns how many streams wait for a slot.
+func (c *Controller) Queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queued
+}
@@ -0,0 +1,114 @@
+package admission
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		admit   []string
+		remote  string
+		wantErr error
+	}{{
+		name:   "unlimited",
+		admit:  []string{"a", "a", "b"},
+		remote: "a",
+	}, {
+		name:    "queue full",
+		config:  Config{MaxStreams: 2},
+		admit:   []string{"a", "b"},
+		remote:  "c",
+		wantErr: ErrQueueFull,
+	}, {
+		name:    "per remote cap",
+		config:  Config{MaxStreams: 3, MaxPerRemote: 1},
+		admit:   []string{"a"},
+		remote:  "a",
+		wantErr: ErrQueueFull,
+	}, {
+		name:   "per remote cap of other remote",
+		config: Config{MaxStreams: 3, MaxPerRemote: 1},
+		admit:  []string{"a"},
+		remote: "b",
+	}, {
+		name:   "no remote",
+		config: Config{MaxStreams: 3, MaxPerRemote: 1},
+		admit:  []string{"", ""},
+		remote: "",
+	}, {
+		name:    "timeout",
+		config:  Config{MaxStreams: 1, MaxQueued: 1, Timeout: 10 * time.Millisecond},
+		admit:   []string{"a"},
+		remote:  "b",
+		wantErr: ErrTimeout,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := New(test.config)
+			for _, remote := range test.admit {
+				if _, err := c.Admit(context.Background(), remote); err != nil {
+					t.Fatalf("admit %q error: %v", remote, err)
+				}
+			}
+
+			_, err := c.Admit(context.Background(), test.remote)
+			if err != test.wantErr {
+				t.Fatalf("admit %q error %v, want %v", test.remote, err, test.wantErr)
+			}
+			if c.Queued() != 0 {
+				t.Fatalf("%d queued after admitting", c.Queued())
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	c := New(Config{MaxStreams: 1, MaxPerRemote: 1, MaxQueued: 1, Timeout: time.Minute})
+	release, err := c.Admit(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("admit error: %v", err)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		_, err := c.Admit(context.Background(), "a")
+		admitted <- err
+	}()
+
+	for c.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	// Releasing again must not free another slot.
+	release()
+
+	if err := <-admitted; err != nil {
+		t.Fatalf("queued admit error: %v", err)
+	}
+	if c.Active() != 1 {
+		t.Fatalf("%d active, want 1", c.Active())
+	}
+}
+
+func TestAdmitCanceled(t *testing.T) {
+	c := New(Config{MaxStreams: 1, MaxQueued: 1, Timeout: time.Minute})
+	if _, err := c.Admit(context.Background(), "a"); err != nil {
+		t.Fatalf("admit error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.Admit(ctx, "b")
+	if err != context.Canceled {
+		t.Fatalf("admit error %v, want %v", err, context.Canceled)
+	}
+	if c.Queued() != 0 {
+		t.Fatalf("%d queued after giving up", c.Queued())
+	}
+}
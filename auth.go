@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"proxy-bench/netx"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// tokenSchemes are the schemes which authenticate sessions with a token at
+// bootstrap, scopeSchemes the ones which hand out proxy capabilities limited
+// to a scope then. Both are set by the creators.
+var (
+	tokenSchemes = make(map[string]bool)
+	scopeSchemes = make(map[string]bool)
+)
+
+func getTokenSchemes() string {
+	return joinSchemes(tokenSchemes)
+}
+
+func getScopeSchemes() string {
+	return joinSchemes(scopeSchemes)
+}
+
+func joinSchemes(set map[string]bool) string {
+	var schemes []string
+	for scheme := range set {
+		schemes = append(schemes, scheme)
+	}
+
+	sort.Strings(schemes)
+	return strings.Join(schemes, ", ")
+}
+
+// readToken reads the token from a file if s is @path, so it doesn't show up
+// in the process list.
+func readToken(s string) (string, error) {
+	path, ok := strings.CutPrefix(s, "@")
+	if !ok {
+		return s, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// parseScope parses comma separated limits: streams, the number of streams
+// open at the same time, and bytes, relayed in both directions, e.g.
+// streams=4,bytes=1G. Missing ones are unlimited.
+func parseScope(s string) (scope netx.Scope, err error) {
+	for _, limit := range splitList(s) {
+		key, value, _ := strings.Cut(limit, "=")
+		switch key {
+		case "streams":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			scope.MaxStreams = uint32(n)
+		case "bytes":
+			var n int64
+			n, err = parseByteSize(value)
+			scope.MaxBytes = uint64(n)
+		default:
+			return scope, fmt.Errorf("unknown limit %q, available: streams, bytes", key)
+		}
+		if err != nil {
+			return scope, fmt.Errorf("limit %q: %w", limit, err)
+		}
+	}
+
+	return scope, nil
+}
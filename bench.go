@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"proxy-bench/netx"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type BenchArgs struct {
+	Streams   int
+	Size      int64
+	ChunkSize int64
+	// ProfileDir is where a results directory with the profiles and the
+	// summary of the run is created, none if empty.
+	ProfileDir string
+	Profiles   []string
+	// Handshakes switches to measuring stream opening instead of
+	// throughput, see runHandshakeBench.
+	Handshakes int
+}
+
+// runBench runs the whole pipeline in this process: an echo server on the
+// connect address, the proxy between listen and connect, and a load generator
+// pushing Streams streams of Size bytes each through the listen address. With
+// mem addresses no sockets are involved at all, e.g.
+// -listen capnp+mem://relay -connect mem://echo.
+func runBench(args Args, benchArgs BenchArgs) {
+	if benchArgs.Handshakes > 0 {
+		runHandshakeBench(args, benchArgs)
+		return
+	}
+
+	// Faults are only injected into the proxy's own connections.
+	echoAddress, _, _, err := parseShapeAddress(args.Connect)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse connect address")
+	}
+	generatorAddress, _, _, err := parseShapeAddress(args.Listen)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse listen address")
+	}
+
+	echo := newServerSession(Args{
+		Listen:   withoutModifier(echoAddress, shapeModifier),
+		CertPath: args.CertPath,
+		KeyPath:  args.KeyPath,
+
+		ClientCAPath: args.ClientCAPath,
+		CertReload:   args.CertReload,
+		TLS:          args.TLS,
+		ListenToken:  args.ConnectToken,
+		KeepAlive:    args.KeepAlive,
+	})
+	go serveEcho(echo)
+
+	server := newServerSession(args)
+	client := newClientSession(args)
+	go serveProxy(args, server, client)
+
+	generator := newClientSession(Args{
+		Connect: withoutModifier(generatorAddress, shapeModifier),
+		CAPath:  args.CAPath,
+
+		ClientCertPath: args.ClientCertPath,
+		ClientKeyPath:  args.ClientKeyPath,
+		CertReload:     args.CertReload,
+		TLS:            args.TLS,
+		Pins:           args.Pins,
+		ConnectToken:   args.ListenToken,
+		KeepAlive:      args.KeepAlive,
+	})
+
+	var out io.Writer = os.Stdout
+	var prof *profiler
+	if benchArgs.ProfileDir != "" {
+		prof, err = startProfiler(benchResultsDir(benchArgs.ProfileDir, args, benchArgs), benchArgs.Profiles)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start profiling")
+		}
+
+		results, err := prof.create("results.txt")
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create bench results")
+		}
+		defer results.Close()
+
+		fmt.Fprintf(results, "Listen: %s\nConnect: %s\nChunk: %d\n", args.Listen, args.Connect, benchArgs.ChunkSize)
+		out = io.MultiWriter(os.Stdout, results)
+	}
+
+	var before, after runtime.MemStats
+	cpuBefore := readCPUSeconds()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, benchArgs.Streams)
+	for i := 0; i < benchArgs.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- runBenchStream(generator, benchArgs)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	cpu := readCPUSeconds() - cpuBefore
+
+	if prof != nil {
+		err = prof.stop()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to write profiles")
+		} else {
+			logger.Info().Str("dir", prof.dir).Msg("Success to write profiles")
+		}
+	}
+
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to run bench stream")
+			failed++
+		}
+	}
+
+	total := benchArgs.Size * int64(benchArgs.Streams-failed)
+	fmt.Fprintf(out, "Streams: %d (%d failed)\n", benchArgs.Streams, failed)
+	fmt.Fprintf(out, "Bytes: %d per direction\n", total)
+	fmt.Fprintf(out, "Elapsed: %s\n", elapsed)
+	fmt.Fprintf(out, "Throughput: %.2f MiB/s\n", float64(total)/elapsed.Seconds()/(1<<20))
+	fmt.Fprintf(out, "CPU: %.2fs (%.0f%%)\n", cpu, cpu/elapsed.Seconds()*100)
+	fmt.Fprintf(out, "Allocs: %d (%d bytes)\n", after.Mallocs-before.Mallocs, after.TotalAlloc-before.TotalAlloc)
+
+	if failed > 0 {
+		logger.Fatal().Int("failed", failed).Msg("Failed to finish bench streams")
+	}
+}
+
+// runBenchStream writes Size bytes and checks that the same bytes come back.
+func runBenchStream(client netx.ClientSession, benchArgs BenchArgs) error {
+	stream, err := client.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	chunk := bytes.Repeat([]byte("proxy-bench\n"), int(benchArgs.ChunkSize/12)+1)[:benchArgs.ChunkSize]
+
+	writeErr := make(chan error, 1)
+	go func() {
+		var err error
+		for sent := int64(0); sent < benchArgs.Size && err == nil; sent += int64(len(chunk)) {
+			_, err = stream.Write(chunk[:min(int64(len(chunk)), benchArgs.Size-sent)])
+		}
+		if err == nil {
+			err = stream.CloseWrite()
+		}
+		writeErr <- err
+	}()
+
+	buf := make([]byte, len(chunk))
+	var received int64
+	for {
+		n, err := stream.Read(buf)
+		for data := buf[:n]; len(data) > 0; {
+			expected := chunk[received%int64(len(chunk)):]
+			expected = expected[:min(len(expected), len(data))]
+			if !bytes.Equal(data[:len(expected)], expected) {
+				return fmt.Errorf("corrupted data at offset %d", received)
+			}
+			data = data[len(expected):]
+			received += int64(len(expected))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = <-writeErr
+	if err != nil {
+		return err
+	}
+	if received != benchArgs.Size {
+		return fmt.Errorf("received %d bytes, expected %d", received, benchArgs.Size)
+	}
+
+	return nil
+}
+
+func serveEcho(server netx.ServerSession) {
+	for {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			logger.Warn().Err(err).Msg("Echo server stopped")
+			return
+		}
+
+		go func() {
+			defer stream.Close()
+			copyStream(stream, stream, "echo", "echo", 0)
+		}()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"proxy-bench/metrics"
+	"proxy-bench/netx"
+	"slices"
+	"time"
+)
+
+// handshakeModes are measured by runHandshakeBench in this order.
+var handshakeModes = []struct {
+	name string
+	// resume enables the client session cache.
+	resume bool
+	// reuse opens all streams on one client session instead of a new one
+	// per stream.
+	reuse bool
+}{
+	{"full", false, false},
+	{"resumed", true, false},
+	{"reused", true, true},
+}
+
+// runHandshakeBench measures what opening a stream costs on the connect
+// transport alone, without the proxy: an echo server runs on the connect
+// address and Handshakes streams are opened one after another, each echoing
+// a single byte. full and resumed connect a new client session for every
+// stream, with full or resumed TLS handshakes, reused opens all streams on
+// one. Per-stream transports like tcp+tls handshake even then, multiplexed
+// ones don't.
+func runHandshakeBench(args Args, benchArgs BenchArgs) {
+	echoAddress, _, _, err := parseShapeAddress(args.Connect)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse connect address")
+	}
+
+	echo := newServerSession(Args{
+		Listen:   withoutModifier(echoAddress, shapeModifier),
+		CertPath: args.CertPath,
+		KeyPath:  args.KeyPath,
+
+		ClientCAPath: args.ClientCAPath,
+		CertReload:   args.CertReload,
+		TLS:          args.TLS,
+		ListenToken:  args.ConnectToken,
+		KeepAlive:    args.KeepAlive,
+	})
+	go serveEcho(echo)
+
+	fmt.Printf("%-8s %8s %11s %8s %10s %10s %10s %10s\n", "Mode", "Streams", "Handshakes", "Resumed", "Mean", "P50", "P90", "P99")
+	for _, mode := range handshakeModes {
+		connect := Args{
+			Connect: args.Connect,
+			CAPath:  args.CAPath,
+
+			ClientCertPath: args.ClientCertPath,
+			ClientKeyPath:  args.ClientKeyPath,
+			CertReload:     args.CertReload,
+			TLS:            args.TLS,
+			Pins:           args.Pins,
+			ConnectToken:   args.ConnectToken,
+			ConnectScope:   args.ConnectScope,
+			KeepAlive:      args.KeepAlive,
+		}
+		connect.TLS.SessionCacheSize = 0
+		if mode.resume {
+			connect.TLS.SessionCacheSize = max(args.TLS.SessionCacheSize, 1)
+		}
+
+		var client netx.ClientSession
+		if mode.reuse {
+			client = newClientSession(connect)
+		}
+		open := func() (time.Duration, error) {
+			if !mode.reuse {
+				client = newClientSession(connect)
+				defer client.Close()
+			}
+
+			return openEchoStream(client)
+		}
+
+		// The first stream fills the session cache and is not measured.
+		_, err := open()
+		if err != nil {
+			logger.Fatal().Err(err).Str("mode", mode.name).Msg("Failed to open bench stream")
+		}
+
+		full := metrics.TLSHandshakes.WithLabelValues("false")
+		resumed := metrics.TLSHandshakes.WithLabelValues("true")
+		fullBefore, resumedBefore := metrics.Value(full), metrics.Value(resumed)
+
+		durations := make([]time.Duration, 0, benchArgs.Handshakes)
+		for i := 0; i < benchArgs.Handshakes; i++ {
+			d, err := open()
+			if err != nil {
+				logger.Fatal().Err(err).Str("mode", mode.name).Msg("Failed to open bench stream")
+			}
+
+			durations = append(durations, d)
+		}
+
+		if mode.reuse {
+			client.Close()
+		}
+
+		resumedCount := metrics.Value(resumed) - resumedBefore
+		handshakes := metrics.Value(full) - fullBefore + resumedCount
+
+		var total time.Duration
+		for _, d := range durations {
+			total += d
+		}
+		slices.Sort(durations)
+
+		fmt.Printf("%-8s %8d %11.0f %8.0f %10s %10s %10s %10s\n", mode.name, len(durations), handshakes, resumedCount,
+			formatLatency(total/time.Duration(len(durations))),
+			formatLatency(percentile(durations, 0.5)),
+			formatLatency(percentile(durations, 0.9)),
+			formatLatency(percentile(durations, 0.99)))
+	}
+}
+
+// openEchoStream opens a stream and waits for one byte to be echoed, that is
+// until the stream is usable end to end.
+func openEchoStream(client netx.ClientSession) (time.Duration, error) {
+	start := time.Now()
+	stream, err := client.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	_, err = stream.Write([]byte{0})
+	if err != nil {
+		return 0, err
+	}
+
+	var buf [1]byte
+	_, err = io.ReadFull(stream, buf[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+// percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[min(int(float64(len(sorted))*p), len(sorted)-1)]
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d)/float64(time.Millisecond))
+}
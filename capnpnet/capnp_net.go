@@ -1,158 +1,442 @@
 package capnpnet
 
 import (
+	"cmp"
 	"context"
-	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"os"
+	"proxy-bench/logx"
+	"proxy-bench/metrics"
 	netx "proxy-bench/netx"
+	"proxy-bench/tracex"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	capnp "capnproto.org/go/capnp/v3"
+	"capnproto.org/go/capnp/v3/exc"
 	"capnproto.org/go/capnp/v3/flowcontrol"
 	"capnproto.org/go/capnp/v3/rpc"
 )
 
+var logger = logx.New("capnpnet")
+
 type ServerSession struct {
 	listener net.Listener
+	token    string
+	scope    netx.Scope
+	admit    netx.Admission
 	incoming chan netx.Stream
 	closedCh chan struct{}
-	mu       sync.Mutex
-	rpcConn  *rpc.Conn
+	once     sync.Once
+
+	// acceptErr is why the listener stopped, set before acceptDone is
+	// closed.
+	acceptErr  error
+	acceptDone chan struct{}
+
+	mu    sync.Mutex
+	conns map[*rpc.Conn]struct{}
 }
 
-func NewServerSession(listener net.Listener) *ServerSession {
-	return &ServerSession{
-		listener: listener,
-		incoming: make(chan netx.Stream),
+// NewServerSession serves every connection accepted from listener, clients
+// may reconnect or several may share the server. The bootstrap capability is
+// a Login, which hands out a Proxy limited to scope for token only, or to
+// anyone if it's empty. Every login gets a Proxy with its own quota. Streams
+// are admitted by admit before openStream returns, so rejections reach the
+// client as overloaded exceptions.
+func NewServerSession(listener net.Listener, token string, scope netx.Scope, admit netx.Admission) *ServerSession {
+	s := &ServerSession{
+		listener:   listener,
+		token:      token,
+		scope:      scope,
+		admit:      admit,
+		incoming:   make(chan netx.Stream),
+		closedCh:   make(chan struct{}),
+		acceptDone: make(chan struct{}),
+		conns:      make(map[*rpc.Conn]struct{}),
 	}
+	go s.acceptConns()
+
+	return s
 }
 
-func (s *ServerSession) bootstrap() (incoming <-chan netx.Stream, err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.rpcConn != nil {
-		return s.incoming, nil
-	}
+func (s *ServerSession) acceptConns() {
+	defer close(s.acceptDone)
 
-	conn, err := s.listener.Accept()
-	if err != nil {
-		return nil, err
-	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.acceptErr = err
+			return
+		}
 
-	rpcServer := Proxy_ServerToClient(s)
-	s.rpcConn = rpc.NewConn(rpc.NewStreamTransport(conn), &rpc.Options{
-		BootstrapClient: capnp.Client(rpcServer),
-	})
+		rpcServer := Login_ServerToClient(&login{s: s, conn: conn})
+		rpcConn := rpc.NewConn(rpc.NewStreamTransport(conn), &rpc.Options{
+			BootstrapClient: capnp.Client(rpcServer),
+		})
 
-	s.incoming = make(chan netx.Stream)
-	return s.incoming, nil
-}
+		s.mu.Lock()
+		s.conns[rpcConn] = struct{}{}
+		s.mu.Unlock()
 
-func (s *ServerSession) AcceptStream() (netx.Stream, error) {
-	incoming, err := s.bootstrap()
-	if err != nil {
-		return nil, err
+		go func() {
+			<-rpcConn.Done()
+			s.mu.Lock()
+			delete(s.conns, rpcConn)
+			s.mu.Unlock()
+		}()
 	}
+}
 
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
 	select {
-	case stream := <-incoming:
+	case stream := <-s.incoming:
 		return stream, nil
 	case <-s.closedCh:
 		return nil, os.ErrClosed
+	case <-s.acceptDone:
+		return nil, s.acceptErr
 	}
 }
 
 func (s *ServerSession) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.rpcConn != nil {
-		s.rpcConn.Close()
-		s.listener.Close()
+	var err error
+	s.once.Do(func() {
 		close(s.closedCh)
-		s.rpcConn = nil
-		s.listener = nil
+		err = s.listener.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for rpcConn := range s.conns {
+			rpcConn.Close()
+		}
+	})
+
+	return err
+}
+
+// login is the bootstrap capability of one connection.
+type login struct {
+	s    *ServerSession
+	conn net.Conn
+}
+
+// Authenticate called by client before anything else
+func (l *login) Authenticate(ctx context.Context, call Login_authenticate) error {
+	token, err := call.Args().Token()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if !netx.CheckToken(l.s.token, string(token)) {
+		metrics.AuthRejected.WithLabelValues("capnp").Inc()
+		return netx.ErrUnauthenticated
+	}
+
+	res, err := call.AllocResults()
+	if err != nil {
+		return err
+	}
+
+	proxy := &scopedProxy{
+		s:     l.s,
+		conn:  l.conn,
+		quota: netx.NewQuota(l.s.scope, nil),
+	}
+	return setProxy(res.SetProxy, res.NewScope, proxy)
+}
+
+// scopedProxy is the Proxy handed out by Login and Restrict, its streams
+// count against quota.
+type scopedProxy struct {
+	s     *ServerSession
+	conn  net.Conn
+	quota *netx.Quota
+}
+
+// setProxy sets the results of the calls returning a Proxy and its scope.
+func setProxy(set func(Proxy) error, newScope func() (Scope, error), p *scopedProxy) error {
+	scope, err := newScope()
+	if err != nil {
+		return err
+	}
+
+	scope.SetMaxStreams(p.quota.Scope().MaxStreams)
+	scope.SetMaxBytes(p.quota.Scope().MaxBytes)
+	return set(Proxy_ServerToClient(p))
 }
 
 // OpenStream called by client
-func (s *ServerSession) OpenStream(ctx context.Context, call Proxy_openStream) error {
+func (p *scopedProxy) OpenStream(ctx context.Context, call Proxy_openStream) error {
+	ctx, span := tracex.Start(context.WithoutCancel(ctx), "capnp.openStream", tracex.KindServer)
+	defer span.End()
+
+	// Calls of a capability are served one at a time until they go async, a
+	// stream waiting for admission mustn't hold up other opens and pings.
+	call.Go()
+
+	err := p.quota.OpenStream()
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
+
+	release, err := p.s.admit.Admit(ctx, p.conn.RemoteAddr())
+	if err != nil {
+		p.quota.CloseStream()
+		span.SetError(err)
+		return &exc.Exception{Type: exc.Overloaded, Cause: err}
+	}
+
 	res, err := call.AllocResults()
 	if err != nil {
+		p.quota.CloseStream()
+		release()
 		return err
 	}
 
 	up := newByteStreamReader()
+	up.quota = p.quota
 	err = res.SetUp(Proxy_ByteStream_ServerToClient(up))
 	if err != nil {
+		p.quota.CloseStream()
+		release()
 		return err
 	}
 
 	down := call.Args().Down().AddRef()
-	down.SetFlowLimiter(flowcontrol.NewFixedLimiter(1024 * 1024 * 4))
+	down.SetFlowLimiter(newFlowLimiter())
+	stream := newCapnpStream(up, down)
+	stream.ctx = ctx
+	stream.quota = p.quota
+	stream.conn = p.conn
+	stream.release = release
 	select {
-	case s.incoming <- newCapnpStream(up, down):
-	case <-s.closedCh:
+	case p.s.incoming <- stream:
+	case <-p.s.closedCh:
+		p.quota.CloseStream()
+		release()
 		down.Release()
 	}
 
 	return nil
 }
 
+// Ping called by client
+func (p *scopedProxy) Ping(ctx context.Context, call Proxy_ping) error {
+	return nil
+}
+
+// Restrict called by client
+func (p *scopedProxy) Restrict(ctx context.Context, call Proxy_restrict) error {
+	scope, err := call.Args().Scope()
+	if err != nil {
+		return err
+	}
+
+	res, err := call.AllocResults()
+	if err != nil {
+		return err
+	}
+
+	restricted := &scopedProxy{
+		s:    p.s,
+		conn: p.conn,
+		quota: netx.NewQuota(netx.Scope{
+			MaxStreams: scope.MaxStreams(),
+			MaxBytes:   scope.MaxBytes(),
+		}, p.quota),
+	}
+	return setProxy(res.SetProxy, res.NewScope, restricted)
+}
+
 type ClientSession struct {
-	network     string
-	address     string
-	tlsConfig   *tls.Config
+	dial        netx.Dialer
+	token       string
+	scope       netx.Scope
+	keepAlive   netx.KeepAlive
 	mu          sync.Mutex
 	rpcConn     *rpc.Conn
+	conn        net.Conn
 	proxyClient Proxy
 }
 
-func NewClientSession(network, address string, tlsConfig *tls.Config) *ClientSession {
+// NewClientSession authenticates with token on every connection dialed, and
+// restricts the Proxy it gets to scope unless that's unlimited. Connections
+// are pinged as set by keepAlive and closed if the server stops answering,
+// the next stream then reconnects.
+func NewClientSession(dial netx.Dialer, token string, scope netx.Scope, keepAlive netx.KeepAlive) *ClientSession {
 	return &ClientSession{
-		network:   network,
-		address:   address,
-		tlsConfig: tlsConfig,
+		dial:      dial,
+		token:     token,
+		scope:     scope,
+		keepAlive: keepAlive,
 	}
 }
 
-func (s *ClientSession) bootstrap() (Proxy, error) {
+func (s *ClientSession) bootstrap(ctx context.Context) (Proxy, net.Conn, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.rpcConn != nil {
-		return s.proxyClient, nil
+		select {
+		case <-s.rpcConn.Done():
+			// Connection lost, reconnect below.
+			s.proxyClient.Release()
+		default:
+			return s.proxyClient, s.conn, nil
+		}
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return Proxy{}, nil, err
 	}
 
-	var conn net.Conn
+	rpcConn := rpc.NewConn(rpc.NewStreamTransport(conn), nil)
+	proxy, err := s.authenticate(ctx, rpcConn)
+	if err != nil {
+		rpcConn.Close()
+		s.rpcConn = nil
+		return Proxy{}, nil, err
+	}
+
+	s.rpcConn = rpcConn
+	s.conn = conn
+	s.proxyClient = proxy
+	if s.keepAlive.Interval > 0 {
+		go s.keepConnAlive(rpcConn, newPinger(proxy))
+	}
+	return s.proxyClient, s.conn, nil
+}
+
+// newPinger derives a Proxy from proxy which is only pinged, so pings never
+// queue behind calls made on proxy. The restrict call is pipelined, nothing
+// waits for it.
+func newPinger(proxy Proxy) Proxy {
+	future, release := proxy.Restrict(context.Background(), func(p Proxy_restrict_Params) error {
+		_, err := p.NewScope()
+		return err
+	})
+	defer release()
+
+	return future.Proxy().AddRef()
+}
+
+// keepConnAlive pings proxy until rpcConn is done or a ping failed.
+func (s *ClientSession) keepConnAlive(rpcConn *rpc.Conn, proxy Proxy) {
+	defer proxy.Release()
+
+	ticker := time.NewTicker(s.keepAlive.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.ping(rpcConn, proxy)
+			if err != nil {
+				logger.Warn().Err(err).Msg("Failed to ping, closed connection")
+				return
+			}
+		case <-rpcConn.Done():
+			return
+		}
+	}
+}
+
+// ping closes rpcConn if the ping fails, before releasing the call, which
+// would wait for the answer otherwise.
+func (s *ClientSession) ping(rpcConn *rpc.Conn, proxy Proxy) error {
+	future, release := proxy.Ping(context.Background(), nil)
+	defer release()
+
+	timeout := time.NewTimer(cmp.Or(s.keepAlive.Timeout, s.keepAlive.Interval))
+	defer timeout.Stop()
+
 	var err error
+	select {
+	case <-future.Done():
+		_, err = future.Struct()
+	case <-timeout.C:
+		err = netx.ErrKeepAliveTimeout
+	}
+	if err != nil {
+		rpcConn.Close()
+	}
 
-	if s.tlsConfig != nil {
-		conn, err = tls.Dial(s.network, s.address, s.tlsConfig)
-	} else {
-		conn, err = net.Dial(s.network, s.address)
+	return err
+}
+
+func (s *ClientSession) authenticate(ctx context.Context, rpcConn *rpc.Conn) (Proxy, error) {
+	login := Login(rpcConn.Bootstrap(context.Background()))
+	defer login.Release()
+
+	future, release := login.Authenticate(ctx, func(p Login_authenticate_Params) error {
+		return p.SetToken([]byte(s.token))
+	})
+	defer release()
+
+	res, err := future.Struct()
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	proxy := res.Proxy().AddRef()
+	if s.scope == (netx.Scope{}) {
+		logScope(res.Scope)
+		return proxy, nil
 	}
+	defer proxy.Release()
+
+	restricted, release := proxy.Restrict(ctx, func(p Proxy_restrict_Params) error {
+		scope, err := p.NewScope()
+		if err != nil {
+			return err
+		}
+
+		scope.SetMaxStreams(s.scope.MaxStreams)
+		scope.SetMaxBytes(s.scope.MaxBytes)
+		return nil
+	})
+	defer release()
+
+	restrictedRes, err := restricted.Struct()
 	if err != nil {
 		return Proxy{}, err
 	}
 
-	s.rpcConn = rpc.NewConn(rpc.NewStreamTransport(conn), nil)
-	s.proxyClient = Proxy(s.rpcConn.Bootstrap(context.Background()))
-	return s.proxyClient, nil
+	logScope(restrictedRes.Scope)
+	return restrictedRes.Proxy().AddRef(), nil
+}
+
+func logScope(scope func() (Scope, error)) {
+	sc, err := scope()
+	if err != nil {
+		return
+	}
+
+	logger.Debug().
+		Uint32("max_streams", sc.MaxStreams()).
+		Uint64("max_bytes", sc.MaxBytes()).
+		Msg("Success to authenticate")
 }
 
 func (s *ClientSession) OpenStream() (netx.Stream, error) {
-	proxy, err := s.bootstrap()
+	return s.OpenStreamContext(context.Background())
+}
+
+func (s *ClientSession) OpenStreamContext(ctx context.Context) (netx.Stream, error) {
+	proxy, conn, err := s.bootstrap(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	_, span := tracex.Start(ctx, "capnp.openStream", tracex.KindClient)
+	defer span.End()
+
 	reader := newByteStreamReader()
 	downStream := Proxy_ByteStream_ServerToClient(reader)
 	future, release := proxy.OpenStream(context.Background(), func(p Proxy_openStream_Params) error {
@@ -161,14 +445,17 @@ func (s *ClientSession) OpenStream() (netx.Stream, error) {
 
 	res, err := future.Struct()
 	if err != nil {
+		span.SetError(err)
 		release()
 		return nil, err
 	}
 
 	reader.release = release
 	writer := res.Up()
-	writer.SetFlowLimiter(flowcontrol.NewFixedLimiter(1024 * 1024 * 4))
-	return newCapnpStream(reader, writer), nil
+	writer.SetFlowLimiter(newFlowLimiter())
+	stream := newCapnpStream(reader, writer)
+	stream.conn = conn
+	return stream, nil
 }
 
 func (s *ClientSession) Close() error {
@@ -180,46 +467,139 @@ func (s *ClientSession) Close() error {
 
 	rpcConn := s.rpcConn
 	s.rpcConn = nil
+	s.conn = nil
 	s.proxyClient = Proxy{}
 	return rpcConn.Close()
 }
 
+// stallThreshold is how long a write has to wait for the flow limiter to
+// count as a stall.
+const stallThreshold = time.Millisecond
+
+// stallCountingLimiter records in metrics how long writes wait for the
+// limiter.
+type stallCountingLimiter struct {
+	flowcontrol.FlowLimiter
+}
+
+// flowLimit is how many bytes of calls may be in flight on a connection. A
+// single message larger than that makes the limiter panic.
+const flowLimit = 4 * 1024 * 1024
+
+// maxWriteSize is the most bytes a write call carries, well below flowLimit
+// to leave room for the message around them.
+const maxWriteSize = flowLimit / 4
+
+func newFlowLimiter() flowcontrol.FlowLimiter {
+	return &stallCountingLimiter{
+		FlowLimiter: flowcontrol.NewFixedLimiter(flowLimit),
+	}
+}
+
+func (l *stallCountingLimiter) StartMessage(ctx context.Context, size uint64) (gotResponse func(), err error) {
+	start := time.Now()
+	gotResponse, err = l.FlowLimiter.StartMessage(ctx, size)
+
+	wait := time.Since(start)
+	if wait >= stallThreshold {
+		metrics.CapnpFlowLimiterStalls.Inc()
+	}
+	metrics.CapnpFlowLimiterWait.Add(wait.Seconds())
+	return
+}
+
 type capnpStream struct {
 	reader *byteStreamReader
 	writer Proxy_ByteStream
 	closed atomic.Bool
+	ctx    context.Context
+
+	// quota of the Proxy which opened the stream on the server side, nil on
+	// the client side.
+	quota    *netx.Quota
+	released atomic.Bool
+	// release gives back the slot the stream was admitted to on the server
+	// side, nil on the client side.
+	release func()
+	// conn is the connection the stream is multiplexed over.
+	conn net.Conn
 }
 
 func newCapnpStream(reader *byteStreamReader, writer Proxy_ByteStream) *capnpStream {
 	return &capnpStream{
 		reader: reader,
 		writer: writer,
+		ctx:    context.Background(),
 	}
 }
 
+func (s *capnpStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *capnpStream) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+func (s *capnpStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *capnpStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
 func (s *capnpStream) Read(p []byte) (n int, err error) {
 	return s.reader.Read(p)
 }
 
+// WriteTo lets io.Copy write received payloads straight to its destination.
+func (s *capnpStream) WriteTo(w io.Writer) (n int64, err error) {
+	return s.reader.WriteTo(w)
+}
+
 func (s *capnpStream) Write(b []byte) (n int, err error) {
 	if s.closed.Load() {
 		return 0, io.ErrClosedPipe
 	}
 
-	err = s.writer.Write(context.Background(), func(p Proxy_ByteStream_write_Params) error {
-		return p.SetBytes(b)
-	})
+	err = s.quota.Use(len(b))
 	if err != nil {
 		return 0, err
 	}
 
-	return len(b), nil
+	_, span := tracex.Start(s.ctx, "capnp.write", tracex.KindClient)
+	span.SetAttribute("bytes", len(b))
+	defer span.End()
+
+	// Larger writes, e.g. whole packets relayed from other transports, are
+	// split into several calls.
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxWriteSize)]
+		err = s.writer.Write(context.Background(), func(p Proxy_ByteStream_write_Params) error {
+			return p.SetBytes(chunk)
+		})
+		if err != nil {
+			span.SetError(err)
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
 }
 
 func (s *capnpStream) Close() error {
 	err := errors.Join(s.CloseWrite(), s.CloseRead())
 
 	s.writer.Release()
+	if s.released.CompareAndSwap(false, true) {
+		s.quota.CloseStream()
+		if s.release != nil {
+			s.release()
+		}
+	}
 	return err
 }
 
@@ -229,12 +609,16 @@ func (s *capnpStream) CloseRead() error {
 
 func (s *capnpStream) CloseWrite() error {
 	if s.closed.CompareAndSwap(false, true) {
+		_, span := tracex.Start(s.ctx, "capnp.end", tracex.KindClient)
+		defer span.End()
+
 		future, release := s.writer.End(context.Background(), func(p Proxy_ByteStream_end_Params) error {
 			return nil
 		})
 		defer release()
 
 		_, err := future.Ptr()
+		span.SetError(err)
 		return err
 	}
 
@@ -242,13 +626,14 @@ func (s *capnpStream) CloseWrite() error {
 }
 
 type byteStreamReader struct {
-	reader  *io.PipeReader
-	writer  *io.PipeWriter
+	reader  *netx.PipeReader
+	writer  *netx.PipeWriter
 	release capnp.ReleaseFunc
+	quota   *netx.Quota
 }
 
 func newByteStreamReader() *byteStreamReader {
-	reader, writer := io.Pipe()
+	reader, writer := netx.Pipe()
 
 	return &byteStreamReader{
 		reader: reader,
@@ -263,6 +648,12 @@ func (s *byteStreamReader) Write(ctx context.Context, call Proxy_ByteStream_writ
 		return err
 	}
 
+	err = s.quota.Use(len(bytes))
+	if err != nil {
+		s.writer.CloseWithError(err)
+		return err
+	}
+
 	_, err = s.writer.Write(bytes)
 	return err
 
@@ -273,6 +664,12 @@ func (s *byteStreamReader) Read(p []byte) (n int, err error) {
 	return s.reader.Read(p)
 }
 
+// WriteTo writes the bytes of every write call to w as they arrive, while
+// the call's message is still held.
+func (s *byteStreamReader) WriteTo(w io.Writer) (n int64, err error) {
+	return s.reader.WriteTo(w)
+}
+
 // Close is CloseRead
 func (s *byteStreamReader) Close() error {
 	s.writer.Close()
@@ -288,3 +685,9 @@ func (s *byteStreamReader) End(ctx context.Context, call Proxy_ByteStream_end) e
 	s.writer.Close()
 	return nil
 }
+
+// Shutdown called when the peer released the stream or its connection was
+// lost, fails reading unless End was called before.
+func (s *byteStreamReader) Shutdown() {
+	s.writer.CloseWithError(io.ErrUnexpectedEOF)
+}
@@ -12,6 +12,86 @@ import (
 	context "context"
 )
 
+type Scope capnp.Struct
+
+// Scope_TypeID is the unique identifier for the type Scope.
+const Scope_TypeID = 0xa0d59ed9691c0210
+
+func NewScope(s *capnp.Segment) (Scope, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 0})
+	return Scope(st), err
+}
+
+func NewRootScope(s *capnp.Segment) (Scope, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 16, PointerCount: 0})
+	return Scope(st), err
+}
+
+func ReadRootScope(msg *capnp.Message) (Scope, error) {
+	root, err := msg.Root()
+	return Scope(root.Struct()), err
+}
+
+func (s Scope) String() string {
+	str, _ := text.Marshal(0xa0d59ed9691c0210, capnp.Struct(s))
+	return str
+}
+
+func (s Scope) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Scope) DecodeFromPtr(p capnp.Ptr) Scope {
+	return Scope(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Scope) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Scope) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Scope) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Scope) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Scope) MaxStreams() uint32 {
+	return capnp.Struct(s).Uint32(0)
+}
+
+func (s Scope) SetMaxStreams(v uint32) {
+	capnp.Struct(s).SetUint32(0, v)
+}
+
+func (s Scope) MaxBytes() uint64 {
+	return capnp.Struct(s).Uint64(8)
+}
+
+func (s Scope) SetMaxBytes(v uint64) {
+	capnp.Struct(s).SetUint64(8, v)
+}
+
+// Scope_List is a list of Scope.
+type Scope_List = capnp.StructList[Scope]
+
+// NewScope creates a new list of Scope.
+func NewScope_List(s *capnp.Segment, sz int32) (Scope_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 16, PointerCount: 0}, sz)
+	return capnp.StructList[Scope](l), err
+}
+
+// Scope_Future is a wrapper for a Scope promised by a client call.
+type Scope_Future struct{ *capnp.Future }
+
+func (f Scope_Future) Struct() (Scope, error) {
+	p, err := f.Future.Ptr()
+	return Scope(p.Struct()), err
+}
+
 type Proxy capnp.Client
 
 // Proxy_TypeID is the unique identifier for the type Proxy.
@@ -37,6 +117,46 @@ func (c Proxy) OpenStream(ctx context.Context, params func(Proxy_openStream_Para
 
 }
 
+func (c Proxy) Restrict(ctx context.Context, params func(Proxy_restrict_Params) error) (Proxy_restrict_Results_Future, capnp.ReleaseFunc) {
+
+	s := capnp.Send{
+		Method: capnp.Method{
+			InterfaceID:   0x9f9ee0cb62fc453f,
+			MethodID:      1,
+			InterfaceName: "proxy.capnp:Proxy",
+			MethodName:    "restrict",
+		},
+	}
+	if params != nil {
+		s.ArgsSize = capnp.ObjectSize{DataSize: 0, PointerCount: 1}
+		s.PlaceArgs = func(s capnp.Struct) error { return params(Proxy_restrict_Params(s)) }
+	}
+
+	ans, release := capnp.Client(c).SendCall(ctx, s)
+	return Proxy_restrict_Results_Future{Future: ans.Future()}, release
+
+}
+
+func (c Proxy) Ping(ctx context.Context, params func(Proxy_ping_Params) error) (Proxy_ping_Results_Future, capnp.ReleaseFunc) {
+
+	s := capnp.Send{
+		Method: capnp.Method{
+			InterfaceID:   0x9f9ee0cb62fc453f,
+			MethodID:      2,
+			InterfaceName: "proxy.capnp:Proxy",
+			MethodName:    "ping",
+		},
+	}
+	if params != nil {
+		s.ArgsSize = capnp.ObjectSize{DataSize: 0, PointerCount: 0}
+		s.PlaceArgs = func(s capnp.Struct) error { return params(Proxy_ping_Params(s)) }
+	}
+
+	ans, release := capnp.Client(c).SendCall(ctx, s)
+	return Proxy_ping_Results_Future{Future: ans.Future()}, release
+
+}
+
 func (c Proxy) WaitStreaming() error {
 	return capnp.Client(c).WaitStreaming()
 }
@@ -111,6 +231,10 @@ func (c Proxy) GetFlowLimiter() fc.FlowLimiter {
 // A Proxy_Server is a Proxy with a local implementation.
 type Proxy_Server interface {
 	OpenStream(context.Context, Proxy_openStream) error
+
+	Restrict(context.Context, Proxy_restrict) error
+
+	Ping(context.Context, Proxy_ping) error
 }
 
 // Proxy_NewServer creates a new Server from an implementation of Proxy_Server.
@@ -129,7 +253,7 @@ func Proxy_ServerToClient(s Proxy_Server) Proxy {
 // This can be used to create a more complicated Server.
 func Proxy_Methods(methods []server.Method, s Proxy_Server) []server.Method {
 	if cap(methods) == 0 {
-		methods = make([]server.Method, 0, 1)
+		methods = make([]server.Method, 0, 3)
 	}
 
 	methods = append(methods, server.Method{
@@ -144,6 +268,30 @@ func Proxy_Methods(methods []server.Method, s Proxy_Server) []server.Method {
 		},
 	})
 
+	methods = append(methods, server.Method{
+		Method: capnp.Method{
+			InterfaceID:   0x9f9ee0cb62fc453f,
+			MethodID:      1,
+			InterfaceName: "proxy.capnp:Proxy",
+			MethodName:    "restrict",
+		},
+		Impl: func(ctx context.Context, call *server.Call) error {
+			return s.Restrict(ctx, Proxy_restrict{call})
+		},
+	})
+
+	methods = append(methods, server.Method{
+		Method: capnp.Method{
+			InterfaceID:   0x9f9ee0cb62fc453f,
+			MethodID:      2,
+			InterfaceName: "proxy.capnp:Proxy",
+			MethodName:    "ping",
+		},
+		Impl: func(ctx context.Context, call *server.Call) error {
+			return s.Ping(ctx, Proxy_ping{call})
+		},
+	})
+
 	return methods
 }
 
@@ -164,6 +312,40 @@ func (c Proxy_openStream) AllocResults() (Proxy_openStream_Results, error) {
 	return Proxy_openStream_Results(r), err
 }
 
+// Proxy_restrict holds the state for a server call to Proxy.restrict.
+// See server.Call for documentation.
+type Proxy_restrict struct {
+	*server.Call
+}
+
+// Args returns the call's arguments.
+func (c Proxy_restrict) Args() Proxy_restrict_Params {
+	return Proxy_restrict_Params(c.Call.Args())
+}
+
+// AllocResults allocates the results struct.
+func (c Proxy_restrict) AllocResults() (Proxy_restrict_Results, error) {
+	r, err := c.Call.AllocResults(capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Proxy_restrict_Results(r), err
+}
+
+// Proxy_ping holds the state for a server call to Proxy.ping.
+// See server.Call for documentation.
+type Proxy_ping struct {
+	*server.Call
+}
+
+// Args returns the call's arguments.
+func (c Proxy_ping) Args() Proxy_ping_Params {
+	return Proxy_ping_Params(c.Call.Args())
+}
+
+// AllocResults allocates the results struct.
+func (c Proxy_ping) AllocResults() (Proxy_ping_Results, error) {
+	r, err := c.Call.AllocResults(capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return Proxy_ping_Results(r), err
+}
+
 // Proxy_List is a list of Proxy.
 type Proxy_List = capnp.CapList[Proxy]
 
@@ -760,49 +942,775 @@ func (p Proxy_openStream_Results_Future) Up() Proxy_ByteStream {
 	return Proxy_ByteStream(p.Future.Field(0, nil).Client())
 }
 
-const schema_89a1f516c2d6455d = "x\xda\x84\x92=h\x14Q\x10\xc7\xff3o/\x9b@" +
-	"\x8e\xe3eE\x89\"\x81\xe0\x07\xa48MR\xf8\x81\x98" +
-	"#r\x08\x82q\xf7\x14\x91\x80\xc8\xc6{\xa0\xe0\xee-" +
-	"\xbb\x1b.[X\x8aX\x08~4\x9e\x01\xc5B\x85t" +
-	"6\x06\x0b\x89Zh!\x96\xda\xa9\xb1\xd4FD\x82\x8d" +
-	"ae/\xbc\xdbS\x0c\xa9\xdf\x7f~\xbfy3\xb3w" +
-	"\x17U\x8c\xd1\xe2\x9e\x02\xd89T\xe8I'\xaa\xbfg" +
-	"\xde.\xdf\xbb\x0f\xd9/\xd2\xb3\xd5\x0f\xaf6\xaf<\xb8" +
-	"\x06\x90u\x99oYWx\x0b`\xdd\xe4\xa3\xd6s6" +
-	"\x81\xf4\xc7\xd2\xfe\xc3o>?~\x04\xb9\x9d\x00\xc3\x04" +
-	"\xc6\x1f\xf2$\xc1HoTO|\xbf0\xbf\xb0\xb0\xf6" +
-	"R\xa0\xec\xe9:\xd7\x08d\xb5x\x02\x94\xeen-\xf7" +
-	"\xdf>r`\x11r\xa0\x13x\xc6\xc3Y\xe0e;\xb0" +
-	":xj\xea\xf4\xe2\xc7\xd7]\xec/|,c\xf3\xa7" +
-	"\x9e\x9fw\xa6\x9e~\xed.}\xc7#Y\xe9\xfb\xact" +
-	"i\xdf\xb6\xf9\x8a\xad~\xc9\x01\x91\x7f\x07d\xad\xf07" +
-	"\x8b\x84\x09X\xab|\xd5:.L\x9cI\x83\xb01\x97" +
-	"\x94\xcf\xbb\x14\xf8\xc1A;l\xccQ\xe2\x18\x94#h" +
-	":\x9dLbu2\x0e\x15\x84\xeb9\x86(\x00\x9d\xe6" +
-	"I\xb7\"\xe54X\xf6\x99i#P\xbe\x0eW\xc8&" +
-	"\xea\x18\xfa\xb4!)k\xa2\xeb\x95\x95_\xdfa\xbb\xa1" +
-	"\xebE\xd0\xc1\xff\xe6\x9a\xe1\xc5X\xad%)r\x0ca" +
-	"\x00\x06\x01\xb28\x068\xbd\x82\x9cMLC3I\xac" +
-	"\"*\x82\xa9\x88\\,r\xa0\xee\xce\xf52\x94\xe9z" +
-	"\x7f\xa1FrT\xa9\xdeh\xfa$\xf5\x18@$\xbb\x88" +
-	"\xc6\xba_\xa9\xa9h\xf6R\x1c\x01\x1b\xd8k**e" +
-	"\xc1n\xfd\xd6\\/f\x83u\xe5\xfc\xaf\xbc\x94\x11m" +
-	"\"\xa7\xb7\xbd\x1b}y\xe4?y\xd1\x1c\xbf{\xae%" +
-	"G\xc7\xc0r\xa7I\xd4\xb9W\xd2\xc7%\x07\x87\xc1\xb2" +
-	"h\x0e\xb5\xe7[!S\xf9\xf5\xf6\xda\xfe\x04\x00\x00\xff" +
-	"\xff\x96\x94\xe9\xcd"
+type Proxy_restrict_Params capnp.Struct
+
+// Proxy_restrict_Params_TypeID is the unique identifier for the type Proxy_restrict_Params.
+const Proxy_restrict_Params_TypeID = 0xef768a8f3e647673
+
+func NewProxy_restrict_Params(s *capnp.Segment) (Proxy_restrict_Params, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return Proxy_restrict_Params(st), err
+}
+
+func NewRootProxy_restrict_Params(s *capnp.Segment) (Proxy_restrict_Params, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return Proxy_restrict_Params(st), err
+}
+
+func ReadRootProxy_restrict_Params(msg *capnp.Message) (Proxy_restrict_Params, error) {
+	root, err := msg.Root()
+	return Proxy_restrict_Params(root.Struct()), err
+}
+
+func (s Proxy_restrict_Params) String() string {
+	str, _ := text.Marshal(0xef768a8f3e647673, capnp.Struct(s))
+	return str
+}
+
+func (s Proxy_restrict_Params) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Proxy_restrict_Params) DecodeFromPtr(p capnp.Ptr) Proxy_restrict_Params {
+	return Proxy_restrict_Params(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Proxy_restrict_Params) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Proxy_restrict_Params) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Proxy_restrict_Params) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Proxy_restrict_Params) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Proxy_restrict_Params) Scope() (Scope, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return Scope(p.Struct()), err
+}
+
+func (s Proxy_restrict_Params) HasScope() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Proxy_restrict_Params) SetScope(v Scope) error {
+	return capnp.Struct(s).SetPtr(0, capnp.Struct(v).ToPtr())
+}
+
+// NewScope sets the scope field to a newly
+// allocated Scope struct, preferring placement in s's segment.
+func (s Proxy_restrict_Params) NewScope() (Scope, error) {
+	ss, err := NewScope(capnp.Struct(s).Segment())
+	if err != nil {
+		return Scope{}, err
+	}
+	err = capnp.Struct(s).SetPtr(0, capnp.Struct(ss).ToPtr())
+	return ss, err
+}
+
+// Proxy_restrict_Params_List is a list of Proxy_restrict_Params.
+type Proxy_restrict_Params_List = capnp.StructList[Proxy_restrict_Params]
+
+// NewProxy_restrict_Params creates a new list of Proxy_restrict_Params.
+func NewProxy_restrict_Params_List(s *capnp.Segment, sz int32) (Proxy_restrict_Params_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1}, sz)
+	return capnp.StructList[Proxy_restrict_Params](l), err
+}
+
+// Proxy_restrict_Params_Future is a wrapper for a Proxy_restrict_Params promised by a client call.
+type Proxy_restrict_Params_Future struct{ *capnp.Future }
+
+func (f Proxy_restrict_Params_Future) Struct() (Proxy_restrict_Params, error) {
+	p, err := f.Future.Ptr()
+	return Proxy_restrict_Params(p.Struct()), err
+}
+func (p Proxy_restrict_Params_Future) Scope() Scope_Future {
+	return Scope_Future{Future: p.Future.Field(0, nil)}
+}
+
+type Proxy_restrict_Results capnp.Struct
+
+// Proxy_restrict_Results_TypeID is the unique identifier for the type Proxy_restrict_Results.
+const Proxy_restrict_Results_TypeID = 0xc2418f5a5052333f
+
+func NewProxy_restrict_Results(s *capnp.Segment) (Proxy_restrict_Results, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Proxy_restrict_Results(st), err
+}
+
+func NewRootProxy_restrict_Results(s *capnp.Segment) (Proxy_restrict_Results, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Proxy_restrict_Results(st), err
+}
+
+func ReadRootProxy_restrict_Results(msg *capnp.Message) (Proxy_restrict_Results, error) {
+	root, err := msg.Root()
+	return Proxy_restrict_Results(root.Struct()), err
+}
+
+func (s Proxy_restrict_Results) String() string {
+	str, _ := text.Marshal(0xc2418f5a5052333f, capnp.Struct(s))
+	return str
+}
+
+func (s Proxy_restrict_Results) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Proxy_restrict_Results) DecodeFromPtr(p capnp.Ptr) Proxy_restrict_Results {
+	return Proxy_restrict_Results(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Proxy_restrict_Results) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Proxy_restrict_Results) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Proxy_restrict_Results) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Proxy_restrict_Results) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Proxy_restrict_Results) Proxy() Proxy {
+	p, _ := capnp.Struct(s).Ptr(0)
+	return Proxy(p.Interface().Client())
+}
+
+func (s Proxy_restrict_Results) HasProxy() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Proxy_restrict_Results) SetProxy(v Proxy) error {
+	if !v.IsValid() {
+		return capnp.Struct(s).SetPtr(0, capnp.Ptr{})
+	}
+	seg := s.Segment()
+	in := capnp.NewInterface(seg, seg.Message().CapTable().Add(capnp.Client(v)))
+	return capnp.Struct(s).SetPtr(0, in.ToPtr())
+}
+
+func (s Proxy_restrict_Results) Scope() (Scope, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return Scope(p.Struct()), err
+}
+
+func (s Proxy_restrict_Results) HasScope() bool {
+	return capnp.Struct(s).HasPtr(1)
+}
+
+func (s Proxy_restrict_Results) SetScope(v Scope) error {
+	return capnp.Struct(s).SetPtr(1, capnp.Struct(v).ToPtr())
+}
+
+// NewScope sets the scope field to a newly
+// allocated Scope struct, preferring placement in s's segment.
+func (s Proxy_restrict_Results) NewScope() (Scope, error) {
+	ss, err := NewScope(capnp.Struct(s).Segment())
+	if err != nil {
+		return Scope{}, err
+	}
+	err = capnp.Struct(s).SetPtr(1, capnp.Struct(ss).ToPtr())
+	return ss, err
+}
+
+// Proxy_restrict_Results_List is a list of Proxy_restrict_Results.
+type Proxy_restrict_Results_List = capnp.StructList[Proxy_restrict_Results]
+
+// NewProxy_restrict_Results creates a new list of Proxy_restrict_Results.
+func NewProxy_restrict_Results_List(s *capnp.Segment, sz int32) (Proxy_restrict_Results_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2}, sz)
+	return capnp.StructList[Proxy_restrict_Results](l), err
+}
+
+// Proxy_restrict_Results_Future is a wrapper for a Proxy_restrict_Results promised by a client call.
+type Proxy_restrict_Results_Future struct{ *capnp.Future }
+
+func (f Proxy_restrict_Results_Future) Struct() (Proxy_restrict_Results, error) {
+	p, err := f.Future.Ptr()
+	return Proxy_restrict_Results(p.Struct()), err
+}
+func (p Proxy_restrict_Results_Future) Proxy() Proxy {
+	return Proxy(p.Future.Field(0, nil).Client())
+}
+
+func (p Proxy_restrict_Results_Future) Scope() Scope_Future {
+	return Scope_Future{Future: p.Future.Field(1, nil)}
+}
+
+type Proxy_ping_Params capnp.Struct
+
+// Proxy_ping_Params_TypeID is the unique identifier for the type Proxy_ping_Params.
+const Proxy_ping_Params_TypeID = 0xfa695782974a2eb0
+
+func NewProxy_ping_Params(s *capnp.Segment) (Proxy_ping_Params, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return Proxy_ping_Params(st), err
+}
+
+func NewRootProxy_ping_Params(s *capnp.Segment) (Proxy_ping_Params, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return Proxy_ping_Params(st), err
+}
+
+func ReadRootProxy_ping_Params(msg *capnp.Message) (Proxy_ping_Params, error) {
+	root, err := msg.Root()
+	return Proxy_ping_Params(root.Struct()), err
+}
+
+func (s Proxy_ping_Params) String() string {
+	str, _ := text.Marshal(0xfa695782974a2eb0, capnp.Struct(s))
+	return str
+}
+
+func (s Proxy_ping_Params) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Proxy_ping_Params) DecodeFromPtr(p capnp.Ptr) Proxy_ping_Params {
+	return Proxy_ping_Params(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Proxy_ping_Params) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Proxy_ping_Params) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Proxy_ping_Params) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Proxy_ping_Params) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+
+// Proxy_ping_Params_List is a list of Proxy_ping_Params.
+type Proxy_ping_Params_List = capnp.StructList[Proxy_ping_Params]
+
+// NewProxy_ping_Params creates a new list of Proxy_ping_Params.
+func NewProxy_ping_Params_List(s *capnp.Segment, sz int32) (Proxy_ping_Params_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0}, sz)
+	return capnp.StructList[Proxy_ping_Params](l), err
+}
+
+// Proxy_ping_Params_Future is a wrapper for a Proxy_ping_Params promised by a client call.
+type Proxy_ping_Params_Future struct{ *capnp.Future }
+
+func (f Proxy_ping_Params_Future) Struct() (Proxy_ping_Params, error) {
+	p, err := f.Future.Ptr()
+	return Proxy_ping_Params(p.Struct()), err
+}
+
+type Proxy_ping_Results capnp.Struct
+
+// Proxy_ping_Results_TypeID is the unique identifier for the type Proxy_ping_Results.
+const Proxy_ping_Results_TypeID = 0xcdaa88cabc9f3c00
+
+func NewProxy_ping_Results(s *capnp.Segment) (Proxy_ping_Results, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return Proxy_ping_Results(st), err
+}
+
+func NewRootProxy_ping_Results(s *capnp.Segment) (Proxy_ping_Results, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0})
+	return Proxy_ping_Results(st), err
+}
+
+func ReadRootProxy_ping_Results(msg *capnp.Message) (Proxy_ping_Results, error) {
+	root, err := msg.Root()
+	return Proxy_ping_Results(root.Struct()), err
+}
+
+func (s Proxy_ping_Results) String() string {
+	str, _ := text.Marshal(0xcdaa88cabc9f3c00, capnp.Struct(s))
+	return str
+}
+
+func (s Proxy_ping_Results) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Proxy_ping_Results) DecodeFromPtr(p capnp.Ptr) Proxy_ping_Results {
+	return Proxy_ping_Results(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Proxy_ping_Results) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Proxy_ping_Results) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Proxy_ping_Results) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Proxy_ping_Results) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+
+// Proxy_ping_Results_List is a list of Proxy_ping_Results.
+type Proxy_ping_Results_List = capnp.StructList[Proxy_ping_Results]
+
+// NewProxy_ping_Results creates a new list of Proxy_ping_Results.
+func NewProxy_ping_Results_List(s *capnp.Segment, sz int32) (Proxy_ping_Results_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 0}, sz)
+	return capnp.StructList[Proxy_ping_Results](l), err
+}
+
+// Proxy_ping_Results_Future is a wrapper for a Proxy_ping_Results promised by a client call.
+type Proxy_ping_Results_Future struct{ *capnp.Future }
+
+func (f Proxy_ping_Results_Future) Struct() (Proxy_ping_Results, error) {
+	p, err := f.Future.Ptr()
+	return Proxy_ping_Results(p.Struct()), err
+}
+
+type Login capnp.Client
+
+// Login_TypeID is the unique identifier for the type Login.
+const Login_TypeID = 0x827d12a52e088a34
+
+func (c Login) Authenticate(ctx context.Context, params func(Login_authenticate_Params) error) (Login_authenticate_Results_Future, capnp.ReleaseFunc) {
+
+	s := capnp.Send{
+		Method: capnp.Method{
+			InterfaceID:   0x827d12a52e088a34,
+			MethodID:      0,
+			InterfaceName: "proxy.capnp:Login",
+			MethodName:    "authenticate",
+		},
+	}
+	if params != nil {
+		s.ArgsSize = capnp.ObjectSize{DataSize: 0, PointerCount: 1}
+		s.PlaceArgs = func(s capnp.Struct) error { return params(Login_authenticate_Params(s)) }
+	}
+
+	ans, release := capnp.Client(c).SendCall(ctx, s)
+	return Login_authenticate_Results_Future{Future: ans.Future()}, release
+
+}
+
+func (c Login) WaitStreaming() error {
+	return capnp.Client(c).WaitStreaming()
+}
+
+// String returns a string that identifies this capability for debugging
+// purposes.  Its format should not be depended on: in particular, it
+// should not be used to compare clients.  Use IsSame to compare clients
+// for equality.
+func (c Login) String() string {
+	return "Login(" + capnp.Client(c).String() + ")"
+}
+
+// AddRef creates a new Client that refers to the same capability as c.
+// If c is nil or has resolved to null, then AddRef returns nil.
+func (c Login) AddRef() Login {
+	return Login(capnp.Client(c).AddRef())
+}
+
+// Release releases a capability reference.  If this is the last
+// reference to the capability, then the underlying resources associated
+// with the capability will be released.
+//
+// Release will panic if c has already been released, but not if c is
+// nil or resolved to null.
+func (c Login) Release() {
+	capnp.Client(c).Release()
+}
+
+// Resolve blocks until the capability is fully resolved or the Context
+// expires.
+func (c Login) Resolve(ctx context.Context) error {
+	return capnp.Client(c).Resolve(ctx)
+}
+
+func (c Login) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Client(c).EncodeAsPtr(seg)
+}
+
+func (Login) DecodeFromPtr(p capnp.Ptr) Login {
+	return Login(capnp.Client{}.DecodeFromPtr(p))
+}
+
+// IsValid reports whether c is a valid reference to a capability.
+// A reference is invalid if it is nil, has resolved to null, or has
+// been released.
+func (c Login) IsValid() bool {
+	return capnp.Client(c).IsValid()
+}
+
+// IsSame reports whether c and other refer to a capability created by the
+// same call to NewClient.  This can return false negatives if c or other
+// are not fully resolved: use Resolve if this is an issue.  If either
+// c or other are released, then IsSame panics.
+func (c Login) IsSame(other Login) bool {
+	return capnp.Client(c).IsSame(capnp.Client(other))
+}
+
+// Update the flowcontrol.FlowLimiter used to manage flow control for
+// this client. This affects all future calls, but not calls already
+// waiting to send. Passing nil sets the value to flowcontrol.NopLimiter,
+// which is also the default.
+func (c Login) SetFlowLimiter(lim fc.FlowLimiter) {
+	capnp.Client(c).SetFlowLimiter(lim)
+}
+
+// Get the current flowcontrol.FlowLimiter used to manage flow control
+// for this client.
+func (c Login) GetFlowLimiter() fc.FlowLimiter {
+	return capnp.Client(c).GetFlowLimiter()
+}
+
+// A Login_Server is a Login with a local implementation.
+type Login_Server interface {
+	Authenticate(context.Context, Login_authenticate) error
+}
+
+// Login_NewServer creates a new Server from an implementation of Login_Server.
+func Login_NewServer(s Login_Server) *server.Server {
+	c, _ := s.(server.Shutdowner)
+	return server.New(Login_Methods(nil, s), s, c)
+}
+
+// Login_ServerToClient creates a new Client from an implementation of Login_Server.
+// The caller is responsible for calling Release on the returned Client.
+func Login_ServerToClient(s Login_Server) Login {
+	return Login(capnp.NewClient(Login_NewServer(s)))
+}
+
+// Login_Methods appends Methods to a slice that invoke the methods on s.
+// This can be used to create a more complicated Server.
+func Login_Methods(methods []server.Method, s Login_Server) []server.Method {
+	if cap(methods) == 0 {
+		methods = make([]server.Method, 0, 1)
+	}
+
+	methods = append(methods, server.Method{
+		Method: capnp.Method{
+			InterfaceID:   0x827d12a52e088a34,
+			MethodID:      0,
+			InterfaceName: "proxy.capnp:Login",
+			MethodName:    "authenticate",
+		},
+		Impl: func(ctx context.Context, call *server.Call) error {
+			return s.Authenticate(ctx, Login_authenticate{call})
+		},
+	})
+
+	return methods
+}
+
+// Login_authenticate holds the state for a server call to Login.authenticate.
+// See server.Call for documentation.
+type Login_authenticate struct {
+	*server.Call
+}
+
+// Args returns the call's arguments.
+func (c Login_authenticate) Args() Login_authenticate_Params {
+	return Login_authenticate_Params(c.Call.Args())
+}
+
+// AllocResults allocates the results struct.
+func (c Login_authenticate) AllocResults() (Login_authenticate_Results, error) {
+	r, err := c.Call.AllocResults(capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Login_authenticate_Results(r), err
+}
+
+// Login_List is a list of Login.
+type Login_List = capnp.CapList[Login]
+
+// NewLogin_List creates a new list of Login.
+func NewLogin_List(s *capnp.Segment, sz int32) (Login_List, error) {
+	l, err := capnp.NewPointerList(s, sz)
+	return capnp.CapList[Login](l), err
+}
+
+type Login_authenticate_Params capnp.Struct
+
+// Login_authenticate_Params_TypeID is the unique identifier for the type Login_authenticate_Params.
+const Login_authenticate_Params_TypeID = 0x83c9f387a4c0aff6
+
+func NewLogin_authenticate_Params(s *capnp.Segment) (Login_authenticate_Params, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return Login_authenticate_Params(st), err
+}
+
+func NewRootLogin_authenticate_Params(s *capnp.Segment) (Login_authenticate_Params, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1})
+	return Login_authenticate_Params(st), err
+}
+
+func ReadRootLogin_authenticate_Params(msg *capnp.Message) (Login_authenticate_Params, error) {
+	root, err := msg.Root()
+	return Login_authenticate_Params(root.Struct()), err
+}
+
+func (s Login_authenticate_Params) String() string {
+	str, _ := text.Marshal(0x83c9f387a4c0aff6, capnp.Struct(s))
+	return str
+}
+
+func (s Login_authenticate_Params) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Login_authenticate_Params) DecodeFromPtr(p capnp.Ptr) Login_authenticate_Params {
+	return Login_authenticate_Params(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Login_authenticate_Params) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Login_authenticate_Params) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Login_authenticate_Params) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Login_authenticate_Params) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Login_authenticate_Params) Token() ([]byte, error) {
+	p, err := capnp.Struct(s).Ptr(0)
+	return []byte(p.Data()), err
+}
+
+func (s Login_authenticate_Params) HasToken() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Login_authenticate_Params) SetToken(v []byte) error {
+	return capnp.Struct(s).SetData(0, v)
+}
+
+// Login_authenticate_Params_List is a list of Login_authenticate_Params.
+type Login_authenticate_Params_List = capnp.StructList[Login_authenticate_Params]
+
+// NewLogin_authenticate_Params creates a new list of Login_authenticate_Params.
+func NewLogin_authenticate_Params_List(s *capnp.Segment, sz int32) (Login_authenticate_Params_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 1}, sz)
+	return capnp.StructList[Login_authenticate_Params](l), err
+}
+
+// Login_authenticate_Params_Future is a wrapper for a Login_authenticate_Params promised by a client call.
+type Login_authenticate_Params_Future struct{ *capnp.Future }
+
+func (f Login_authenticate_Params_Future) Struct() (Login_authenticate_Params, error) {
+	p, err := f.Future.Ptr()
+	return Login_authenticate_Params(p.Struct()), err
+}
+
+type Login_authenticate_Results capnp.Struct
+
+// Login_authenticate_Results_TypeID is the unique identifier for the type Login_authenticate_Results.
+const Login_authenticate_Results_TypeID = 0x9b17a4cd97773b9e
+
+func NewLogin_authenticate_Results(s *capnp.Segment) (Login_authenticate_Results, error) {
+	st, err := capnp.NewStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Login_authenticate_Results(st), err
+}
+
+func NewRootLogin_authenticate_Results(s *capnp.Segment) (Login_authenticate_Results, error) {
+	st, err := capnp.NewRootStruct(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2})
+	return Login_authenticate_Results(st), err
+}
+
+func ReadRootLogin_authenticate_Results(msg *capnp.Message) (Login_authenticate_Results, error) {
+	root, err := msg.Root()
+	return Login_authenticate_Results(root.Struct()), err
+}
+
+func (s Login_authenticate_Results) String() string {
+	str, _ := text.Marshal(0x9b17a4cd97773b9e, capnp.Struct(s))
+	return str
+}
+
+func (s Login_authenticate_Results) EncodeAsPtr(seg *capnp.Segment) capnp.Ptr {
+	return capnp.Struct(s).EncodeAsPtr(seg)
+}
+
+func (Login_authenticate_Results) DecodeFromPtr(p capnp.Ptr) Login_authenticate_Results {
+	return Login_authenticate_Results(capnp.Struct{}.DecodeFromPtr(p))
+}
+
+func (s Login_authenticate_Results) ToPtr() capnp.Ptr {
+	return capnp.Struct(s).ToPtr()
+}
+func (s Login_authenticate_Results) IsValid() bool {
+	return capnp.Struct(s).IsValid()
+}
+
+func (s Login_authenticate_Results) Message() *capnp.Message {
+	return capnp.Struct(s).Message()
+}
+
+func (s Login_authenticate_Results) Segment() *capnp.Segment {
+	return capnp.Struct(s).Segment()
+}
+func (s Login_authenticate_Results) Proxy() Proxy {
+	p, _ := capnp.Struct(s).Ptr(0)
+	return Proxy(p.Interface().Client())
+}
+
+func (s Login_authenticate_Results) HasProxy() bool {
+	return capnp.Struct(s).HasPtr(0)
+}
+
+func (s Login_authenticate_Results) SetProxy(v Proxy) error {
+	if !v.IsValid() {
+		return capnp.Struct(s).SetPtr(0, capnp.Ptr{})
+	}
+	seg := s.Segment()
+	in := capnp.NewInterface(seg, seg.Message().CapTable().Add(capnp.Client(v)))
+	return capnp.Struct(s).SetPtr(0, in.ToPtr())
+}
+
+func (s Login_authenticate_Results) Scope() (Scope, error) {
+	p, err := capnp.Struct(s).Ptr(1)
+	return Scope(p.Struct()), err
+}
+
+func (s Login_authenticate_Results) HasScope() bool {
+	return capnp.Struct(s).HasPtr(1)
+}
+
+func (s Login_authenticate_Results) SetScope(v Scope) error {
+	return capnp.Struct(s).SetPtr(1, capnp.Struct(v).ToPtr())
+}
+
+// NewScope sets the scope field to a newly
+// allocated Scope struct, preferring placement in s's segment.
+func (s Login_authenticate_Results) NewScope() (Scope, error) {
+	ss, err := NewScope(capnp.Struct(s).Segment())
+	if err != nil {
+		return Scope{}, err
+	}
+	err = capnp.Struct(s).SetPtr(1, capnp.Struct(ss).ToPtr())
+	return ss, err
+}
+
+// Login_authenticate_Results_List is a list of Login_authenticate_Results.
+type Login_authenticate_Results_List = capnp.StructList[Login_authenticate_Results]
+
+// NewLogin_authenticate_Results creates a new list of Login_authenticate_Results.
+func NewLogin_authenticate_Results_List(s *capnp.Segment, sz int32) (Login_authenticate_Results_List, error) {
+	l, err := capnp.NewCompositeList(s, capnp.ObjectSize{DataSize: 0, PointerCount: 2}, sz)
+	return capnp.StructList[Login_authenticate_Results](l), err
+}
+
+// Login_authenticate_Results_Future is a wrapper for a Login_authenticate_Results promised by a client call.
+type Login_authenticate_Results_Future struct{ *capnp.Future }
+
+func (f Login_authenticate_Results_Future) Struct() (Login_authenticate_Results, error) {
+	p, err := f.Future.Ptr()
+	return Login_authenticate_Results(p.Struct()), err
+}
+func (p Login_authenticate_Results_Future) Proxy() Proxy {
+	return Proxy(p.Future.Field(0, nil).Client())
+}
+
+func (p Login_authenticate_Results_Future) Scope() Scope_Future {
+	return Scope_Future{Future: p.Future.Field(1, nil)}
+}
+
+const schema_89a1f516c2d6455d = "x\xda\xc4\x95Al\x14U\x18\xc7\xbfo\xde\xbc\xf9\xda" +
+	"\xa4M\xfb\xfa\x8a j\xaad\x1b\xb5\xd1M\xb7\xc5\xa0" +
+	"\x08t\x07\xd3\xa8M\xc1\x9d\xa5hlb\xcc\xd0N`" +
+	"\xd5\x9d]w\xa7\xb4=x\x10\x0f\x08\x17\xb4\xc6`m" +
+	",\x9a\x80&\xbd\xa8\x17\xb9\x98\x80\x1c$jz\xe0\x80" +
+	"I\x0f*\x1c<`bH%j$\xe2\x987;o" +
+	"w[\x96\x94x\xf1\xf0\xbf\xbc\xf9\xde\xf7\xbe\xf7\xfb\xfe" +
+	"\xdf\xbc\xde\xac\x916S\xad[,0\x9c\xa7\xb8\x15n" +
+	">\xda\x94<\xd5\xf1\xda!\x10-,|a\xf0\xfbs" +
+	"w\xfc\xfe\xd1\x11\x00\x94\xc8fd3\xa3XOJ\x9b" +
+	"\x91R\xf8\xc7\xa7gO\x1e\xbe\xf6\xcd\x1b :\x10\x80" +
+	"#\x01\xf4?\xcc\xfaPng\x14k\x00@N0\x0a" +
+	"\xe7\x1f\x9f<\xbexr\xfd\\\x1cj\xa8P\x97mE" +
+	"\xf9*\xa3X\x93\x00\xf2WF\xe1\xc0\xe0\xdf\xfb\xbe\xbb" +
+	"4\x7f\xe2\xa62\x96\xd8\x8c\xbc\xcc\xd6\xcbeFr\x99" +
+	"\x9d\x97\xef\x9a\xa4\x14\xb6\x1bw\xe7\x96\xe6/~\x08N" +
+	"\x0b\x1a\xb5\x1d&\x01\xc8\xd7\xcd\x19y\xc4\xa4X\xea\x08" +
+	"\xce)\\>\xf3\xe8\x8e\xf3?}\xf21\x88{\x10\xa2" +
+	"\xc0\xfees'J\xe4\xa4\x05 o\x98\x14\xbe5\xf8" +
+	"\xcc\xd5\x03s\x0b\x0b\x95\xc8\xca\x15\xaf\x98YT\x1fc" +
+	"\xa9+>\xc2)\xbc\x7f\xf6R\xcb;O<v\xba\x9e" +
+	"\xc6}|\x13\xca\x14\xa7X*4\xcf)\x1c\xe8\xcff" +
+	"F\x8f\xd9\xe7\xeai<\xcf7\xa2\xccq\x8a\xa5J\xfd" +
+	"\x99Sx\xe3\xce\x91\xdd\xcf\x9e\xfe\xe1\xeb\xbaR/\xf0" +
+	"!T\xdf\xb4\x00\xe4eN\xffl;\xf1\xe5\xb7o." +
+	",\x8a\x8e8N.\xf2\xebr\x89\x93\x16\x80\xbc\xc8)" +
+	"4~\xb4\xae\xbd\xb7\xfb\x8b+\xf5e~\xc5{P^" +
+	"\xe0\x14K\x95\xd9jQX>8\xbe\xe3\xd8\xd1\x83W" +
+	"\xebC\xff\xe2\x1d(\x9b-\x8a\xa5B\x07-:\xb3\xe5" +
+	"\xae\xb9t\xc6\xfbSt\xb0Z\xff\x00e\xca\xfaEn" +
+	"\xb7(\xd6ay\xca\"\xa5\xf0\xb3\xe4\xd0\xf1C\xcf\xe5" +
+	"\xaeC\xad\xda\xb7\xad\xdf\xe4\x07\x16i\x01\xc8Y\x8b\xe0" +
+	"\xde\xb0X*LM'\xc7\\,\xfa\xc5\xad\xc3\x85\xfd" +
+	"9\xf43\x88\x194\x1c\x93q\x80\xaa\x09Q[L\x88" +
+	"\x97\xc4:\xb2;\xd1\xeeD\xb1\x8eBw\"8\xe0\xf9" +
+	"A\x0e\xda\xc6\xdc\xc0\xcb\xa0\x01\x98\xc6\x0cb\x1a\xab\xb9" +
+	"\x99\xce\xed'u\xb4\x8aMd\xba\xdc\x92\x9b/W\xcf" +
+	"3\x01L\x04\x10\xad}\x00N\x13C\xa7\xd3\xc0\xae\xa0" +
+	"\xf0\xb2\xe7c+\x18\xd8\x0a\xb7\x934;\xe0\x95'^" +
+	"\x09t\xd6\xa6j\xd6\x07U\xd6\x04Cg\xb3\x81\x02\xb1" +
+	"\x13\xd5bJ->\xc4\xd0\xd9f`W\x94\x1aE\x1d" +
+	"bH#\x00\x0a\xc0\xae\xf2X\xa1\xe8a{m\x1a\xe2" +
+	"o\xed+\x8a\x8a(fJ\x85)\x9cvL\xc4j\xdf" +
+	"p4\xdc9\x1dx{\x82\x92\x07\xcc\xcd\xab\xc2Z\"" +
+	"\xbc\xda\xd5\xa8}#\x9cQ\xb1\x97\xec\x11\xb4GP\xec" +
+	"%\xc4\xaaMP\xdbZ<=$v\x91=\x8c\xf60" +
+	"\x8a]\x84F\xb5\xdf\x08\xda\xa5v\x8f\xb0\xc9N\xa3\x9d" +
+	"FaSX(z~\xdd\xe1Q\xcd%\xaf\x1c\x94r" +
+	"c\x01\x00\xc4Km\xc5\x9c\xbf\xbfa\x07\xa3{\xed\x19" +
+	"+\x14\xd1\xbb\x99\xeb(\x80\xf3\xc0j\xaeC\x00No" +
+	"\x85k\x98w\xa7\xd4\xe1.\xb0|\x19\x9b\xc0\xc0&\x88" +
+	"\x16\x15\x922\x00`3\x18\xd8\xbc\x02\xa4\xa9AN'" +
+	"587\x9f\xf4\xfc\xf1D&\xf2\x0cT\xca\xc80s" +
+	"\xcdM\x93\xa5\\\xe0U\xb6\xe1\x1a^\xdb\xa7\x0a\xba\x95" +
+	"\xd7*\x895I7\xafRRC\xfb\xf6\xc4)7\x18" +
+	"\xd86^\x98\xf4Qh#\xd4\x0c\xd58\xbb\xeeI\"" +
+	"\xabL\xcc\xfe'\x17\xdf\x1a~\xb62[\xd0\x10\xbfQ" +
+	"\xdb\xa6\x8c\xb4j\x12W\xc66&\x9a\xf5\xcamu\xb3" +
+	"[\x87tc\x0d)\x9b(\xfe\x07\xa0k\xf6\x7f\x83q" +
+	"\xbbx\x8c\xd5x\xdaT\xf1\xd5N\xa9\xb1\xd6\xef\x1a\xfa" +
+	"\x9f\x9f\x9d\xec\x7f\xff\xc5Y\x91\xea\x13)\xb2{\xd1\xee" +
+	"E\x91Rc\xad\x1fI\xd4O\x90\xe8\xde$\xba\xc9N" +
+	"\xa0\x9d@\xd1M]\x91o\xe3i$\xcf\x1fo8\x98" +
+	"\xab\x99\xaf\xf8\xa5F\xc8\xff\x1d\x00\xaf\xac4\xe2"
 
 func RegisterSchema(reg *schemas.Registry) {
 	reg.Register(&schemas.Schema{
 		String: schema_89a1f516c2d6455d,
 		Nodes: []uint64{
+			0x827d12a52e088a34,
+			0x83c9f387a4c0aff6,
+			0x9b17a4cd97773b9e,
 			0x9f9ee0cb62fc453f,
+			0xa0d59ed9691c0210,
 			0xa6a7dfc73e38bff1,
 			0xaaaa9b68ef4f4590,
 			0xb73943930ce09927,
+			0xc2418f5a5052333f,
 			0xc6ddb7564e5419fd,
+			0xcdaa88cabc9f3c00,
 			0xe9b64e98f306de02,
+			0xef768a8f3e647673,
 			0xf7006550409b1b37,
+			0xfa695782974a2eb0,
 		},
 		Compressed: true,
 	})
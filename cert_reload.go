@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate from files which are reloaded when they
+// change or on SIGHUP. Only new handshakes get the new certificate, so
+// established connections, and the streams multiplexed over them, are kept.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+var (
+	reloadersMu sync.Mutex
+	reloaders   = make(map[[2]string]*certReloader)
+	hangup      sync.Once
+)
+
+// getCertReloader returns the reloader of the given files, every TLS config
+// using them shares it. interval is how often the files are checked for
+// changes, never if zero.
+func getCertReloader(certPath, keyPath string, interval time.Duration) (*certReloader, error) {
+	reloadersMu.Lock()
+	defer reloadersMu.Unlock()
+
+	key := [2]string{certPath, keyPath}
+	if r, ok := reloaders[key]; ok {
+		return r, nil
+	}
+
+	r := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	reloaders[key] = r
+
+	if interval > 0 {
+		go r.watch(interval)
+	}
+	hangup.Do(func() {
+		go reloadOnHangup()
+	})
+
+	return r, nil
+}
+
+func reloadOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadersMu.Lock()
+		for _, r := range reloaders {
+			r.reloadLogged()
+		}
+		reloadersMu.Unlock()
+	}
+}
+
+// reload loads the files, keeping the current certificate if they are
+// broken, e.g. while only one of them was replaced yet.
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The time is taken before loading, so changes made meanwhile are loaded
+	// by the next check. Failed loads are retried by every check until one
+	// succeeds.
+	modTime := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) reloadLogged() {
+	err := r.reload()
+	if err != nil {
+		logger.Error().Err(err).Str("cert", r.certPath).Msg("Failed to reload certificate, keeping the current one")
+		return
+	}
+
+	logger.Info().Str("cert", r.certPath).Time("expires", r.cert.Load().Leaf.NotAfter).Msg("Success to reload certificate")
+}
+
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		changed := !r.lastModified().Equal(r.modTime)
+		r.mu.Unlock()
+
+		if changed {
+			r.reloadLogged()
+		}
+	}
+}
+
+// lastModified is the latest modification time of the files.
+func (r *certReloader) lastModified() time.Time {
+	var last time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	return last
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
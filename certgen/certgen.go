@@ -0,0 +1,220 @@
+package certgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+type KeyType string
+
+const (
+	RSA     KeyType = "rsa"
+	ECDSA   KeyType = "ecdsa"
+	Ed25519 KeyType = "ed25519"
+)
+
+func ParseKeyType(s string) (KeyType, error) {
+	switch keyType := KeyType(s); keyType {
+	case RSA, ECDSA, Ed25519:
+		return keyType, nil
+	default:
+		return "", fmt.Errorf("unknown key type %q, available: rsa, ecdsa, ed25519", s)
+	}
+}
+
+// Options are shared by all generated certificates.
+type Options struct {
+	KeyType KeyType
+	// RSABits is the RSA key size, 2048 if zero.
+	RSABits  int
+	Validity time.Duration
+}
+
+// backdate makes certificates valid a bit before they were made, for clocks
+// running behind.
+const backdate = 24 * time.Hour
+
+// Cert is a certificate with its private key.
+type Cert struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewCA creates a self-signed CA certificate.
+func NewCA(name string, opts Options) (*Cert, error) {
+	template, err := newTemplate(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	return create(template, nil, opts)
+}
+
+// NewServer issues a server certificate for hosts, which are DNS names or IP
+// addresses.
+func (ca *Cert) NewServer(name string, hosts []string, opts Options) (*Cert, error) {
+	return ca.issue(name, hosts, x509.ExtKeyUsageServerAuth, opts)
+}
+
+// NewClient issues a client certificate for mutual TLS.
+func (ca *Cert) NewClient(name string, opts Options) (*Cert, error) {
+	return ca.issue(name, nil, x509.ExtKeyUsageClientAuth, opts)
+}
+
+func (ca *Cert) issue(name string, hosts []string, usage x509.ExtKeyUsage, opts Options) (*Cert, error) {
+	template, err := newTemplate(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if opts.KeyType == RSA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	return create(template, ca, opts)
+}
+
+func newTemplate(name string, opts Options) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"proxy-bench"}, CommonName: name},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(opts.Validity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// create signs template with the key of parent, or self-signs it if parent is
+// nil.
+func create(template *x509.Certificate, parent *Cert, opts Options) (*Cert, error) {
+	key, err := newKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.Cert, parent.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cert{
+		Cert: cert,
+		Key:  key,
+	}, nil
+}
+
+func newKey(opts Options) (crypto.Signer, error) {
+	switch opts.KeyType {
+	case RSA:
+		bits := opts.RSABits
+		if bits == 0 {
+			bits = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q", opts.KeyType)
+	}
+}
+
+func (c *Cert) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+}
+
+// KeyPEM encodes the key in PKCS #8, which fits all key types.
+func (c *Cert) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// TLSCertificate is the certificate ready for a tls.Config.
+func (c *Cert) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.Cert.Raw},
+		PrivateKey:  c.Key,
+		Leaf:        c.Cert,
+	}
+}
+
+// Write writes the certificate and key files, the key only readable by the
+// owner.
+func (c *Cert) Write(certPath, keyPath string) error {
+	key, err := c.KeyPEM()
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(certPath, c.CertPEM(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyPath, key, 0600)
+}
+
+// Load reads a certificate and key written by Write, or by openssl.
+func Load(certPath, keyPath string) (*Cert, error) {
+	tlsCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key can't sign")
+	}
+
+	return &Cert{
+		Cert: tlsCert.Leaf,
+		Key:  key,
+	}, nil
+}
@@ -0,0 +1,99 @@
+package certgen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMutualTLS(t *testing.T) {
+	for _, keyType := range []KeyType{RSA, ECDSA, Ed25519} {
+		t.Run(string(keyType), func(t *testing.T) {
+			opts := Options{
+				KeyType:  keyType,
+				Validity: time.Hour,
+			}
+
+			ca, err := NewCA("test CA", opts)
+			if err != nil {
+				t.Fatalf("CA error: %v", err)
+			}
+			server, err := ca.NewServer("localhost", []string{"localhost", "127.0.0.1"}, opts)
+			if err != nil {
+				t.Fatalf("server cert error: %v", err)
+			}
+			client, err := ca.NewClient("test client", opts)
+			if err != nil {
+				t.Fatalf("client cert error: %v", err)
+			}
+
+			// Certificates are used as loaded back from their files.
+			dir := t.TempDir()
+			server = writeAndLoad(t, server, filepath.Join(dir, "server"))
+			client = writeAndLoad(t, client, filepath.Join(dir, "client"))
+
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.Cert)
+
+			serverConfig := &tls.Config{
+				Certificates: []tls.Certificate{server.TLSCertificate()},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}
+			clientConfig := &tls.Config{
+				Certificates: []tls.Certificate{client.TLSCertificate()},
+				RootCAs:      pool,
+				ServerName:   "127.0.0.1",
+			}
+
+			serverConn, clientConn := net.Pipe()
+			tlsServer := tls.Server(serverConn, serverConfig)
+			tlsClient := tls.Client(clientConn, clientConfig)
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			// A side failing closes its end, so the other one doesn't wait on
+			// it forever.
+			errs := make(chan error, 1)
+			go func() {
+				err := tlsServer.Handshake()
+				if err != nil {
+					serverConn.Close()
+				}
+				errs <- err
+			}()
+
+			err = tlsClient.Handshake()
+			if err != nil {
+				clientConn.Close()
+			}
+			err = errors.Join(err, <-errs)
+			if err != nil {
+				t.Fatalf("handshake error: %v", err)
+			}
+
+			peers := tlsServer.ConnectionState().PeerCertificates
+			if len(peers) == 0 || !peers[0].Equal(client.Cert) {
+				t.Fatalf("server didn't get the client certificate")
+			}
+		})
+	}
+}
+
+func writeAndLoad(t *testing.T, cert *Cert, path string) *Cert {
+	err := cert.Write(path+"-cert.pem", path+"-key.pem")
+	if err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	loaded, err := Load(path+"-cert.pem", path+"-key.pem")
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+
+	return loaded
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"net"
+	"proxy-bench/memnet"
+	"proxy-bench/metrics"
+	"proxy-bench/netx"
+	"proxy-bench/shapenet"
+	"proxy-bench/tracex"
+	"sync/atomic"
+	"time"
+)
+
+// Connection based transports get their listeners and dialers from here, so
+// the address modifiers work the same for all of them: tls wraps connections
+// in TLS, shape injects faults beneath it and mem replaces the network with
+// an in-process one, e.g. capnp+tls+shape+mem://name?delay=20ms.
+
+func listenConn(args Args, network, address string) (net.Listener, error) {
+	listener, err := listenRawConn(network, address, args.KeepAlive)
+	if err != nil {
+		return nil, err
+	}
+
+	if args.ListenShape != nil {
+		listener = shapenet.WrapListener(listener, *args.ListenShape)
+	}
+
+	return listener, nil
+}
+
+func listenRawConn(network, address string, keepAlive netx.KeepAlive) (net.Listener, error) {
+	_, _, addr := splitAddress(address)
+	if isMemAddress(address) {
+		name, _, err := parseMemAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return memnet.Listen(name)
+	}
+
+	var listenConfig net.ListenConfig
+	listenConfig.KeepAlive, listenConfig.KeepAliveConfig = tcpKeepAlive(keepAlive)
+	return listenConfig.Listen(context.Background(), network, addr)
+}
+
+// tcpKeepAlive has the kernel probe idle TCP connections like sessions ping,
+// so a peer not answering is given up on after keepAlive.Interval plus
+// keepAlive.Timeout. It also covers transports without pings of their own.
+// The period is negative to disable probes.
+func tcpKeepAlive(keepAlive netx.KeepAlive) (period time.Duration, config net.KeepAliveConfig) {
+	if keepAlive.Interval <= 0 {
+		return -1, net.KeepAliveConfig{}
+	}
+
+	return 0, net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     keepAlive.Interval,
+		Interval: cmp.Or(keepAlive.Timeout, keepAlive.Interval),
+		Count:    1,
+	}
+}
+
+// listenTLSConn is listenConn wrapped in TLS if the address asks for it.
+func listenTLSConn(args Args, network, address string) (net.Listener, error) {
+	listener, err := listenConn(args, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	_, tlsEnabled, _ := splitAddress(address)
+	if tlsEnabled {
+		tlsConfig, err := getServerTLSConfig(args)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	logger.Info().Str("address", address).Msg("Listened")
+	return listener, nil
+}
+
+func newDialer(args Args, network, address string) (netx.Dialer, error) {
+	dial, err := newRawDialer(network, address, args.KeepAlive)
+	if err != nil {
+		return nil, err
+	}
+	dial = traceDial(dial)
+	if args.ConnectShape == nil {
+		return dial, nil
+	}
+
+	config := *args.ConnectShape
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return shapenet.WrapConn(conn, config), nil
+	}, nil
+}
+
+// traceDial adds a span for every dial, below the stream opening it if any.
+func traceDial(dial netx.Dialer) netx.Dialer {
+	return func(ctx context.Context) (net.Conn, error) {
+		_, span := tracex.Start(ctx, "dial", tracex.KindClient)
+		defer span.End()
+
+		conn, err := dial(ctx)
+		if err != nil {
+			span.SetError(err)
+			return nil, err
+		}
+
+		span.SetAttribute("remote", conn.RemoteAddr().String())
+		return conn, nil
+	}
+}
+
+func newRawDialer(network, address string, keepAlive netx.KeepAlive) (netx.Dialer, error) {
+	_, _, addr := splitAddress(address)
+	if isMemAddress(address) {
+		name, config, err := parseMemAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx context.Context) (net.Conn, error) {
+			return memnet.Dial(name, config)
+		}, nil
+	}
+
+	var dialer net.Dialer
+	dialer.KeepAlive, dialer.KeepAliveConfig = tcpKeepAlive(keepAlive)
+	return func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// newTLSDialer is newDialer wrapped in TLS if the address asks for it.
+func newTLSDialer(args Args, network, address string) (netx.Dialer, error) {
+	dial, err := newDialer(args, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	_, tlsEnabled, _ := splitAddress(address)
+	if !tlsEnabled {
+		return dial, nil
+	}
+
+	tlsConfig, err := getClientTLSConfigFor(args, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}, nil
+}
+
+// countReconnects counts every dial after the first one in
+// metrics.Reconnects, for transports which keep a single connection.
+func countReconnects(scheme string, dial netx.Dialer) netx.Dialer {
+	var dialed atomic.Bool
+	reconnects := metrics.Reconnects.WithLabelValues(scheme)
+	return func(ctx context.Context) (net.Conn, error) {
+		if dialed.Swap(true) {
+			reconnects.Inc()
+		}
+
+		return dial(ctx)
+	}
+}
+
+// getClientTLSConfigFor is getClientTLSConfig with the server name taken from
+// the address, like tls.Dial does. In-process addresses have no host name,
+// they verify against localhost.
+func getClientTLSConfigFor(args Args, address string) (*tls.Config, error) {
+	tlsConfig, err := getClientTLSConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		_, _, addr := splitAddress(address)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil || isMemAddress(address) {
+			host = "localhost"
+		}
+		tlsConfig.ServerName = host
+	}
+
+	return tlsConfig, nil
+}
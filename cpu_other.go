@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// readCPUSeconds is not implemented on this platform.
+func readCPUSeconds() float64 {
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// readCPUSeconds returns the user and system CPU time used by this process.
+func readCPUSeconds() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+
+	cpu := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+	return cpu.Seconds()
+}
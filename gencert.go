@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"proxy-bench/certgen"
+	"strings"
+	"time"
+)
+
+// runGenCert implements the gencert subcommand: it writes a CA, a server and a
+// client certificate into a directory, under the default names of -ca, -cert,
+// -key, -client-cert and -client-key. An existing CA is reused unless -new-ca
+// is given, so certificates can be renewed without redistributing ca.pem.
+func runGenCert(argv []string) {
+	flags := flag.NewFlagSet("gencert", flag.ExitOnError)
+	dir := flags.String("dir", ".", "Directory to write the certificates to")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "SANs of the server certificate, DNS names or IP addresses")
+	keyTypeName := flags.String("key-type", "rsa", "Key type: rsa, ecdsa (P-256) or ed25519")
+	rsaBits := flags.Int("rsa-bits", 2048, "RSA key size")
+	validity := flags.Duration("validity", 180*24*time.Hour, "Validity of the certificates")
+	newCA := flags.Bool("new-ca", false, "Create a new CA even if the directory has one")
+	flags.Parse(argv)
+
+	keyType, err := certgen.ParseKeyType(*keyTypeName)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse key type")
+	}
+
+	opts := certgen.Options{
+		KeyType:  keyType,
+		RSABits:  *rsaBits,
+		Validity: *validity,
+	}
+	path := func(name string) string {
+		return filepath.Join(*dir, name)
+	}
+
+	err = os.MkdirAll(*dir, 0775)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create certificate directory")
+	}
+
+	var ca *certgen.Cert
+	if !*newCA {
+		ca, err = certgen.Load(path("ca.pem"), path("ca-key.pem"))
+		// A new CA is only created if neither file exists, one left alone
+		// would be overwritten or not match the new one.
+		if errors.Is(err, fs.ErrNotExist) && (fileExists(path("ca.pem")) || fileExists(path("ca-key.pem"))) {
+			logger.Fatal().Err(err).Msg("Failed to load CA, only one of ca.pem and ca-key.pem exists")
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Fatal().Err(err).Msg("Failed to load CA")
+		}
+		if ca != nil {
+			logger.Info().Str("path", path("ca.pem")).Msg("Success to load CA")
+		}
+	}
+	if ca == nil {
+		ca, err = certgen.NewCA("proxy-bench CA", opts)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create CA")
+		}
+
+		writeCert(ca, path("ca.pem"), path("ca-key.pem"))
+	}
+
+	serverHosts := strings.Split(*hosts, ",")
+	server, err := ca.NewServer(serverHosts[0], serverHosts, opts)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create server certificate")
+	}
+	writeCert(server, path("server-cert.pem"), path("server-key.pem"))
+
+	client, err := ca.NewClient("proxy-bench-client", opts)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create client certificate")
+	}
+	writeCert(client, path("client-cert.pem"), path("client-key.pem"))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func writeCert(cert *certgen.Cert, certPath, keyPath string) {
+	err := cert.Write(certPath, keyPath)
+	if err != nil {
+		logger.Fatal().Err(err).Str("path", certPath).Msg("Failed to write certificate")
+	}
+
+	logger.Info().Str("path", certPath).Time("expires", cert.Cert.NotAfter).Str("spki", spkiPin(cert.Cert)).Msg("Success to write certificate")
+}
@@ -7,8 +7,10 @@ import (
 )
 
 func init() {
+	tokenSchemes["grpc"] = true
+	admissionSchemes["grpc"] = true
 	serverSessionCreators["grpc"] = func(args Args) (netx.ServerSession, error) {
-		_, tlsEnabled, address := splitAddress(args.Listen)
+		_, tlsEnabled, _ := splitAddress(args.Listen)
 		var tlsConfig *tls.Config
 		var err error
 		if tlsEnabled {
@@ -18,7 +20,12 @@ func init() {
 			}
 		}
 
-		return grpcnet.NewServerSession("tcp", address, tlsConfig), nil
+		listener, err := listenConn(args, "tcp", args.Listen)
+		if err != nil {
+			return nil, err
+		}
+
+		return grpcnet.NewServerSession(listener, tlsConfig, args.ListenToken, args.Admission, args.KeepAlive), nil
 	}
 
 	clientSessionCreators["grpc"] = func(args Args) (netx.ClientSession, error) {
@@ -26,12 +33,17 @@ func init() {
 		var tlsConfig *tls.Config
 		var err error
 		if tlsEnabled {
-			tlsConfig, err = getClientTLSConfig(args)
+			tlsConfig, err = getClientTLSConfigFor(args, args.Connect)
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		return grpcnet.NewClientSession("tcp", address, tlsConfig), nil
+		dial, err := newDialer(args, "tcp", args.Connect)
+		if err != nil {
+			return nil, err
+		}
+
+		return grpcnet.NewClientSession(address, countReconnects("grpc", dial), tlsConfig, args.ConnectToken, args.KeepAlive), nil
 	}
 }
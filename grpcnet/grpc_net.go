@@ -1,39 +1,56 @@
 package grpcnet
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"os"
+	"proxy-bench/logx"
+	"proxy-bench/metrics"
 	"proxy-bench/netx"
+	"proxy-bench/tracex"
+	"strings"
 	sync "sync"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
+var logger = logx.New("grpcnet")
+
 type ServerSession struct {
 	UnimplementedProxyServer
-	network   string
-	address   string
+	listener  net.Listener
 	tlsConfig *tls.Config
+	token     string
+	admit     netx.Admission
+	keepAlive netx.KeepAlive
 	mu        sync.Mutex
 	incoming  chan netx.Stream
 	closedCh  chan struct{}
 	rpcServer *grpc.Server
 }
 
-func NewServerSession(network, address string, tlsConfig *tls.Config) *ServerSession {
+// NewServerSession serves streams of clients sending token in their metadata,
+// of any client if it's empty. Streams rejected by admit end with
+// RESOURCE_EXHAUSTED. Connections are pinged as set by keepAlive.
+func NewServerSession(listener net.Listener, tlsConfig *tls.Config, token string, admit netx.Admission, keepAlive netx.KeepAlive) *ServerSession {
 	return &ServerSession{
-		network:   network,
-		address:   address,
+		listener:  listener,
 		tlsConfig: tlsConfig,
+		token:     token,
+		admit:     admit,
+		keepAlive: keepAlive,
 		incoming:  make(chan netx.Stream),
 		closedCh:  make(chan struct{}),
 	}
@@ -45,18 +62,30 @@ func (s *ServerSession) bootstrap() (<-chan netx.Stream, error) {
 	if s.rpcServer != nil {
 		return s.incoming, nil
 	}
-
-	listener, err := net.Listen(s.network, s.address)
-	if err != nil {
-		return nil, err
+	select {
+	case <-s.closedCh:
+		return nil, os.ErrClosed
+	default:
 	}
-	log.Printf("Success to listen on %s", s.address)
 
 	var serverOpts []grpc.ServerOption
 	if s.tlsConfig != nil {
-		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+		serverOpts = append(serverOpts, grpc.Creds(countFrames(credentials.NewTLS(s.tlsConfig))))
 	} else {
-		serverOpts = append(serverOpts, grpc.Creds(insecure.NewCredentials()))
+		serverOpts = append(serverOpts, grpc.Creds(countFrames(insecure.NewCredentials())))
+	}
+	serverOpts = append(serverOpts, grpc.StreamInterceptor(s.authenticate))
+	// Clients ping as often as they're configured to, gRPC's default policy
+	// would close their connections for pinging more than every 5 minutes.
+	serverOpts = append(serverOpts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             minPingInterval,
+		PermitWithoutStream: true,
+	}))
+	if s.keepAlive.Interval > 0 {
+		serverOpts = append(serverOpts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    s.keepAlive.Interval,
+			Timeout: s.keepAlive.Timeout,
+		}))
 	}
 
 	server := grpc.NewServer(serverOpts...)
@@ -65,9 +94,9 @@ func (s *ServerSession) bootstrap() (<-chan netx.Stream, error) {
 		defer func() {
 			close(s.closedCh)
 		}()
-		err := server.Serve(listener)
+		err := server.Serve(s.listener)
 		if err != nil {
-			log.Printf("gRPC Server stopped with error: %v", err)
+			logger.Warn().Err(err).Msg("gRPC Server stopped")
 		}
 	}()
 
@@ -75,6 +104,32 @@ func (s *ServerSession) bootstrap() (<-chan netx.Stream, error) {
 	return s.incoming, nil
 }
 
+// minPingInterval is how often servers let clients ping, less than the 10s
+// gRPC clients ping at most.
+const minPingInterval = 5 * time.Second
+
+// authenticateKey is the metadata carrying the token, as a bearer token.
+const authenticateKey = "authorization"
+
+// authenticate rejects streams without the token before they reach
+// OpenStream.
+func (s *ServerSession) authenticate(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	values := md.Get(authenticateKey)
+	presented := ""
+	if len(values) == 1 {
+		presented = strings.TrimPrefix(values[0], "Bearer ")
+	}
+
+	if !netx.CheckToken(s.token, presented) {
+		metrics.AuthRejected.WithLabelValues("grpc").Inc()
+		logger.Debug().Str("method", info.FullMethod).Msg("Rejected unauthenticated stream")
+		return status.Error(codes.Unauthenticated, netx.ErrUnauthenticated.Error())
+	}
+
+	return handler(srv, stream)
+}
+
 func (s *ServerSession) AcceptStream() (netx.Stream, error) {
 	incoming, err := s.bootstrap()
 	if err != nil {
@@ -91,16 +146,43 @@ func (s *ServerSession) AcceptStream() (netx.Stream, error) {
 
 // OpenStream called by client
 func (s *ServerSession) OpenStream(grpcStream grpc.BidiStreamingServer[Packet, Packet]) error {
-	log.Printf("Recved OpenStream call from client")
+	logger.Debug().Msg("Recved OpenStream call from client")
 
+	ctx, span := tracex.Start(context.WithoutCancel(grpcStream.Context()), "grpc.OpenStream", tracex.KindServer)
 	done := make(chan struct{})
 	stream := newGrpcStream(grpcStream, func() {
 		close(done)
 	})
+	stream.ctx = ctx
+	if p, ok := peer.FromContext(grpcStream.Context()); ok {
+		stream.localAddr, stream.remoteAddr = p.LocalAddr, p.Addr
+	}
+
+	// Waiting in the admission queue ends early if the client gives up.
+	release, err := s.admit.Admit(grpcStream.Context(), stream.remoteAddr)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Rejected stream")
+		span.SetError(err)
+		span.End()
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	defer release()
+
+	// The headers tell the client its stream was admitted, see
+	// OpenStreamContext.
+	err = grpcStream.SendHeader(metadata.MD{})
+	if err != nil {
+		span.SetError(err)
+		span.End()
+		return err
+	}
 
 	select {
 	case s.incoming <- stream:
+		span.End()
 	case <-s.closedCh:
+		span.SetError(os.ErrClosed)
+		span.End()
 		return os.ErrClosed
 	}
 
@@ -120,26 +202,33 @@ func (s *ServerSession) Close() error {
 		return nil
 	}
 
+	// Serve returns once stopped, closing closedCh.
 	s.rpcServer.Stop()
 	s.rpcServer = nil
-	close(s.closedCh)
 	return nil
 }
 
 type ClientSession struct {
-	network   string
 	address   string
+	dial      netx.Dialer
 	tlsConfig *tls.Config
+	token     string
+	keepAlive netx.KeepAlive
 	mu        sync.Mutex
 	rpcConn   *grpc.ClientConn
 	rpcClient ProxyClient
 }
 
-func NewClientSession(network, address string, tlsConfig *tls.Config) *ClientSession {
+// NewClientSession creates a session to address. Connections are opened by
+// dial, TLS is done by gRPC itself. token is sent with every stream.
+// Connections are pinged as set by keepAlive, gRPC pings every 10s at most.
+func NewClientSession(address string, dial netx.Dialer, tlsConfig *tls.Config, token string, keepAlive netx.KeepAlive) *ClientSession {
 	return &ClientSession{
-		network:   network,
 		address:   address,
+		dial:      dial,
 		tlsConfig: tlsConfig,
+		token:     token,
+		keepAlive: keepAlive,
 	}
 }
 
@@ -150,15 +239,29 @@ func (s *ClientSession) bootstrap() (ProxyClient, error) {
 		return s.rpcClient, nil
 	}
 
-	var dialOpts []grpc.DialOption
+	dialOpts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.dial(ctx)
+		}),
+	}
 
 	if s.tlsConfig != nil {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(s.tlsConfig)))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(countFrames(credentials.NewTLS(s.tlsConfig))))
 	} else {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(countFrames(insecure.NewCredentials())))
+	}
+	if s.token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCreds(s.token)))
+	}
+	if s.keepAlive.Interval > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                s.keepAlive.Interval,
+			Timeout:             s.keepAlive.Timeout,
+			PermitWithoutStream: true,
+		}))
 	}
 
-	grpcConn, err := grpc.NewClient(s.address, dialOpts...)
+	grpcConn, err := grpc.NewClient("passthrough:///"+s.address, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -169,13 +272,31 @@ func (s *ClientSession) bootstrap() (ProxyClient, error) {
 }
 
 func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+func (s *ClientSession) OpenStreamContext(ctx context.Context) (netx.Stream, error) {
 	client, err := s.bootstrap()
 	if err != nil {
 		return nil, err
 	}
 
+	_, span := tracex.Start(ctx, "grpc.OpenStream", tracex.KindClient)
+	defer span.End()
+
 	stream, err := client.OpenStream(context.Background())
 	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	// Servers send the headers once they admitted the stream, and end it with
+	// RESOURCE_EXHAUSTED instead if they rejected it. The client can't know
+	// whether a server admits streams at all, so every open costs this round
+	// trip, deliberately, to fail opens which would only fail on first read.
+	_, err = stream.Header()
+	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
@@ -196,72 +317,186 @@ func (s *ClientSession) Close() error {
 	return nil
 }
 
+// tokenCreds sends the token as bearer token, over plain connections too, it's
+// a benchmark.
+type tokenCreds string
+
+func (c tokenCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authenticateKey: "Bearer " + string(c)}, nil
+}
+
+func (c tokenCreds) RequireTransportSecurity() bool {
+	return false
+}
+
+// frameCountingCreds hands the connections to metrics.CountGRPCFrames after
+// the handshake, where the HTTP/2 frames are no longer encrypted.
+type frameCountingCreds struct {
+	credentials.TransportCredentials
+}
+
+func countFrames(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return &frameCountingCreds{
+		TransportCredentials: creds,
+	}
+}
+
+func (c *frameCountingCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return metrics.CountGRPCFrames(conn, true), authInfo, nil
+}
+
+func (c *frameCountingCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return metrics.CountGRPCFrames(conn, false), authInfo, nil
+}
+
+func (c *frameCountingCreds) Clone() credentials.TransportCredentials {
+	return countFrames(c.TransportCredentials.Clone())
+}
+
 type grpcBidiStream interface {
 	Recv() (*Packet, error)
 	Send(*Packet) error
+	Context() context.Context
 }
 
 type grpcStream struct {
 	stream        grpcBidiStream
-	buf           bytes.Buffer
 	readClosed    atomic.Bool
 	writeClosed   atomic.Bool
 	closeCallback func()
+	closeOnce     sync.Once
+	ctx           context.Context
+	recvBatch     callBatch
+	sendBatch     callBatch
+	// pending is what Read left over of the last packet.
+	pending []byte
+	// localAddr and remoteAddr are those of the connection of accepted
+	// streams, nil for opened ones.
+	localAddr  net.Addr
+	remoteAddr net.Addr
 }
 
 func newGrpcStream(stream grpcBidiStream, closeCallback func()) *grpcStream {
 	return &grpcStream{
 		stream:        stream,
 		closeCallback: closeCallback,
+		ctx:           context.Background(),
+		recvBatch:     callBatch{name: "grpc.Recv"},
+		sendBatch:     callBatch{name: "grpc.Send"},
 	}
 }
 
+func (s *grpcStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcStream) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+func (s *grpcStream) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *grpcStream) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
 func (s *grpcStream) Read(p []byte) (n int, err error) {
-	if s.buf.Len() > 0 {
-		return s.buf.Read(p)
+	if len(s.pending) == 0 {
+		s.pending, err = s.recv()
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	if s.readClosed.Load() {
-		return 0, io.EOF
-	}
+	n = copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
 
-	packet, err := s.stream.Recv()
-	if err != nil {
-		return 0, err
+// WriteTo lets io.Copy write the data of received packets straight to its
+// destination.
+func (s *grpcStream) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		data := s.pending
+		s.pending = nil
+		if len(data) == 0 {
+			data, err = s.recv()
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+		}
+
+		written, err := w.Write(data)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
 	}
-	copied := copy(p, packet.Data)
-	if copied == len(packet.Data) {
-		return copied, nil
+}
+
+func (s *grpcStream) recv() ([]byte, error) {
+	if s.readClosed.Load() {
+		return nil, io.EOF
 	}
 
-	_, err = s.buf.Write(packet.Data[copied:])
+	s.recvBatch.begin(s.ctx)
+	packet, err := s.stream.Recv()
+	s.recvBatch.done(len(packet.GetData()), err)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	return copied, nil
+	return packet.Data, nil
 }
 
+// maxWriteSize is the most bytes a Send carries, well below the 4 MiB
+// message size gRPC receivers accept by default.
+const maxWriteSize = 1024 * 1024
+
 func (s *grpcStream) Write(p []byte) (n int, err error) {
 	if s.writeClosed.Load() {
 		return 0, io.ErrClosedPipe
 	}
 
-	err = s.stream.Send(&Packet{
-		Data: p,
-	})
-
-	if err != nil {
-		return 0, err
+	// Larger writes, e.g. whole payloads relayed from other transports, are
+	// split into several packets.
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxWriteSize)]
+		s.sendBatch.begin(s.ctx)
+		err = s.stream.Send(&Packet{
+			Data: chunk,
+		})
+		s.sendBatch.done(len(chunk), err)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
 	}
 
-	return len(p), nil
+	return n, nil
 }
 
 func (s *grpcStream) Close() error {
 	err := errors.Join(s.CloseRead(), s.CloseWrite())
+	// Streams may be closed more than once, e.g. by an idle timeout and
+	// again when the relay is done.
 	if s.closeCallback != nil {
-		s.closeCallback()
+		s.closeOnce.Do(s.closeCallback)
 	}
 
 	return err
@@ -274,6 +509,7 @@ func (s *grpcStream) CloseRead() error {
 
 func (s *grpcStream) CloseWrite() error {
 	if s.writeClosed.CompareAndSwap(false, true) {
+		s.sendBatch.end(nil)
 		if cs, ok := s.stream.(interface {
 			CloseSend() error
 		}); ok {
@@ -283,3 +519,66 @@ func (s *grpcStream) CloseWrite() error {
 
 	return nil
 }
+
+// batchSize is how many Send or Recv calls are traced in one span, tracing
+// every single call would cost more than the calls themselves.
+const batchSize = 64
+
+// callBatch traces consecutive calls of one kind in a single span. The batch
+// may be ended by closing the stream while a call is made on another
+// goroutine.
+type callBatch struct {
+	name  string
+	mu    sync.Mutex
+	span  *tracex.Span
+	calls int
+	bytes int
+}
+
+func (b *callBatch) begin(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.span == nil {
+		_, b.span = tracex.Start(ctx, b.name, tracex.KindClient)
+	}
+}
+
+func (b *callBatch) done(n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.span == nil {
+		return
+	}
+
+	b.calls++
+	b.bytes += n
+	if err != nil || b.calls == batchSize {
+		b.endLocked(err)
+	}
+}
+
+func (b *callBatch) end(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.endLocked(err)
+}
+
+func (b *callBatch) endLocked(err error) {
+	if b.span == nil {
+		return
+	}
+
+	b.span.SetAttribute("calls", b.calls)
+	b.span.SetAttribute("bytes", b.bytes)
+	if err != io.EOF {
+		b.span.SetError(err)
+	}
+	b.span.End()
+
+	b.span = nil
+	b.calls = 0
+	b.bytes = 0
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"proxy-bench/h2net"
+	"proxy-bench/netx"
+)
+
+func init() {
+	serverSessionCreators["h2"] = func(args Args) (netx.ServerSession, error) {
+		listener, err := listenTLSConn(args, "tcp", args.Listen)
+		if err != nil {
+			return nil, err
+		}
+
+		return h2net.NewServerSession(listener, args.KeepAlive), nil
+	}
+
+	clientSessionCreators["h2"] = func(args Args) (netx.ClientSession, error) {
+		_, tlsEnabled, address := splitAddress(args.Connect)
+		dial, err := newTLSDialer(args, "tcp", args.Connect)
+		if err != nil {
+			return nil, err
+		}
+
+		return h2net.NewClientSession(address, countReconnects("h2", dial), tlsEnabled, args.KeepAlive), nil
+	}
+}
@@ -0,0 +1,349 @@
+package h2net
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"proxy-bench/logx"
+	"proxy-bench/netx"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+var logger = logx.New("h2net")
+
+// streamPath is requested with POST for every stream. The request body carries
+// the client to server direction, the response body the other one.
+const streamPath = "/stream"
+
+const maxConcurrentStreams = 1024
+
+// connKey is the context key of the connection a request came in on.
+type connKey struct{}
+
+type ServerSession struct {
+	listener net.Listener
+	server   *http2.Server
+	mu       sync.Mutex
+	serving  bool
+	incoming chan netx.Stream
+	closedCh chan struct{}
+}
+
+// NewServerSession serves HTTP/2 on listener: h2c with prior knowledge, or h2
+// negotiated through ALPN if listener is a TLS listener. Connections are
+// pinged as set by keepAlive.
+func NewServerSession(listener net.Listener, keepAlive netx.KeepAlive) *ServerSession {
+	return &ServerSession{
+		listener: listener,
+		server: &http2.Server{
+			MaxConcurrentStreams: maxConcurrentStreams,
+			ReadIdleTimeout:      keepAlive.Interval,
+			PingTimeout:          keepAlive.Timeout,
+		},
+		incoming: make(chan netx.Stream),
+		closedCh: make(chan struct{}),
+	}
+}
+
+func (s *ServerSession) bootstrap() (<-chan netx.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.serving {
+		return s.incoming, nil
+	}
+
+	listener := s.listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logger.Warn().Err(err).Msg("HTTP/2 listener stopped")
+				return
+			}
+
+			go s.serveConn(conn)
+		}
+	}()
+
+	s.serving = true
+	return s.incoming, nil
+}
+
+func (s *ServerSession) serveConn(conn net.Conn) {
+	// The http2 package checks the negotiated protocol, so the handshake must
+	// be done before serving.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			logger.Warn().Err(err).Stringer("remote", conn.RemoteAddr()).Msg("Failed TLS handshake")
+			conn.Close()
+			return
+		}
+	}
+
+	logger.Debug().Stringer("remote", conn.RemoteAddr()).Msg("Accepted HTTP/2 connection")
+	s.server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: context.WithValue(context.Background(), connKey{}, conn),
+		Handler: s,
+	})
+}
+
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
+	incoming, err := s.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.closedCh:
+		return nil, os.ErrClosed
+	case stream := <-incoming:
+		return stream, nil
+	}
+}
+
+// ServeHTTP called by client
+func (s *ServerSession) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != streamPath {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// Send the response headers now, the client's round trip only returns
+	// once it gets them.
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	err := rc.Flush()
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to flush response headers")
+		return
+	}
+
+	stream := newServerStream(rc, w, r.Body)
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		stream.localAddr, stream.remoteAddr = conn.LocalAddr(), conn.RemoteAddr()
+	}
+	defer stream.finish()
+
+	select {
+	case s.incoming <- stream:
+	case <-s.closedCh:
+		return
+	}
+
+	select {
+	case <-stream.done:
+	case <-r.Context().Done():
+	}
+}
+
+func (s *ServerSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closedCh:
+		return nil
+	default:
+	}
+
+	close(s.closedCh)
+	return s.listener.Close()
+}
+
+type ClientSession struct {
+	url       string
+	transport *http2.Transport
+}
+
+// NewClientSession creates a session to address. Connections are opened by
+// dial, which also does the TLS handshake if tlsEnabled. Connections are
+// pinged as set by keepAlive.
+func NewClientSession(address string, dial netx.Dialer, tlsEnabled bool, keepAlive netx.KeepAlive) *ClientSession {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx)
+		},
+		ReadIdleTimeout: keepAlive.Interval,
+		PingTimeout:     keepAlive.Timeout,
+	}
+
+	scheme := "http"
+	if tlsEnabled {
+		scheme = "https"
+	}
+
+	return &ClientSession{
+		url:       scheme + "://" + address + streamPath,
+		transport: transport,
+	}
+}
+
+func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, s.url, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.transport.RoundTrip(req)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		writer.Close()
+		resp.Body.Close()
+		return nil, errors.New("unexpected response status: " + resp.Status)
+	}
+
+	return &clientStream{
+		body:   resp.Body,
+		writer: writer,
+	}, nil
+}
+
+func (s *ClientSession) Close() error {
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+// clientStream writes into the request body and reads from the response body.
+type clientStream struct {
+	body   io.ReadCloser
+	writer *io.PipeWriter
+}
+
+func (s *clientStream) Read(p []byte) (n int, err error) {
+	return s.body.Read(p)
+}
+
+func (s *clientStream) Write(p []byte) (n int, err error) {
+	return s.writer.Write(p)
+}
+
+func (s *clientStream) Close() error {
+	return errors.Join(s.CloseWrite(), s.CloseRead())
+}
+
+// CloseRead resets the stream unless the response body was read to EOF.
+func (s *clientStream) CloseRead() error {
+	return s.body.Close()
+}
+
+// CloseWrite ends the request body, sending END_STREAM.
+func (s *clientStream) CloseWrite() error {
+	return s.writer.Close()
+}
+
+// serverStream reads from the request body and writes into the response body.
+//
+// The response can only be ended by returning from the handler, and the
+// http2 package resets a stream whose handler returns before the request body
+// was fully read, with RST_STREAM NO_ERROR after the END_STREAM of the
+// response. So CloseWrite ends the response right away, which also ends the
+// request body unless it was read to the end already: a half-close from the
+// server reaches the client, but the client can't send anything after it.
+type serverStream struct {
+	rc        *http.ResponseController
+	w         http.ResponseWriter
+	body      io.ReadCloser
+	mu        sync.RWMutex
+	finished  bool
+	readDone  atomic.Bool
+	writeDone atomic.Bool
+	done      chan struct{}
+	doneOnce  sync.Once
+	// localAddr and remoteAddr are those of the connection the request came
+	// in on.
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func newServerStream(rc *http.ResponseController, w http.ResponseWriter, body io.ReadCloser) *serverStream {
+	return &serverStream{
+		rc:   rc,
+		w:    w,
+		body: body,
+		done: make(chan struct{}),
+	}
+}
+
+func (s *serverStream) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *serverStream) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *serverStream) Read(p []byte) (n int, err error) {
+	n, err = s.body.Read(p)
+	if err == io.EOF {
+		s.readDone.Store(true)
+		s.checkDone()
+	}
+
+	return n, err
+}
+
+func (s *serverStream) Write(p []byte) (n int, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.finished || s.writeDone.Load() {
+		return 0, io.ErrClosedPipe
+	}
+
+	n, err = s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.rc.Flush()
+}
+
+func (s *serverStream) Close() error {
+	s.readDone.Store(true)
+	s.writeDone.Store(true)
+	s.checkDone()
+	return nil
+}
+
+func (s *serverStream) CloseRead() error {
+	s.readDone.Store(true)
+	s.checkDone()
+	return nil
+}
+
+func (s *serverStream) CloseWrite() error {
+	s.writeDone.Store(true)
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *serverStream) checkDone() {
+	if s.readDone.Load() && s.writeDone.Load() {
+		s.doneOnce.Do(func() {
+			close(s.done)
+		})
+	}
+}
+
+// finish is called as the handler returns; the response writer must not be
+// used afterwards.
+func (s *serverStream) finish() {
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout is why relays closed by their idle timer ended.
+var errIdleTimeout = errors.New("idle timeout")
+
+// streamIdleTimeout is how long relayed streams may send nothing in either
+// direction, zero is forever.
+var streamIdleTimeout time.Duration
+
+// idleTimer calls onIdle once it wasn't touched for timeout. Touching only
+// stores the time, the timer checks it when it fires and sleeps again for
+// what's left. A nil idleTimer never fires.
+type idleTimer struct {
+	timeout time.Duration
+	last    atomic.Int64
+	fired   atomic.Bool
+	timer   *time.Timer
+}
+
+// newIdleTimer returns nil if timeout is zero.
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	if timeout <= 0 {
+		return nil
+	}
+
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	// Armed only once t.timer is set, check resets it.
+	t.timer = time.AfterFunc(time.Hour, func() {
+		t.check(onIdle)
+	})
+	t.timer.Reset(timeout)
+
+	return t
+}
+
+func (t *idleTimer) check(onIdle func()) {
+	idle := time.Since(time.Unix(0, t.last.Load()))
+	if idle < t.timeout {
+		t.timer.Reset(t.timeout - idle)
+		return
+	}
+
+	t.fired.Store(true)
+	onIdle()
+}
+
+func (t *idleTimer) touch() {
+	if t == nil {
+		return
+	}
+
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *idleTimer) stop() {
+	if t == nil {
+		return
+	}
+
+	t.timer.Stop()
+}
+
+// expired reports whether onIdle was called.
+func (t *idleTimer) expired() bool {
+	return t != nil && t.fired.Load()
+}
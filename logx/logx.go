@@ -0,0 +1,139 @@
+package logx
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Every package gets its own named logger from New at init time. Configure
+// later replaces them in place with the level set for their name, so it must
+// run before any of them is used concurrently, i.e. right after flag parsing.
+
+type entry struct {
+	logger   *zerolog.Logger
+	internal bool
+}
+
+var (
+	mu      sync.Mutex
+	entries = make(map[string]*entry)
+	base    = zerolog.New(newConsoleWriter()).With().Timestamp().Logger()
+)
+
+// New returns the logger of the named package, at info level until
+// configured otherwise.
+func New(name string) *zerolog.Logger {
+	return register(name, false, zerolog.InfoLevel)
+}
+
+// NewInternal returns a logger for the internals of a dependency, which is
+// disabled unless its level is set by name.
+func NewInternal(name string) *zerolog.Logger {
+	return register(name, true, zerolog.Disabled)
+}
+
+func register(name string, internal bool, level zerolog.Level) *zerolog.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e, ok := entries[name]; ok {
+		return e.logger
+	}
+
+	logger := base.Level(level).With().Str("pkg", name).Logger()
+	entries[name] = &entry{
+		logger:   &logger,
+		internal: internal,
+	}
+	return &logger
+}
+
+// Configure sets the output format, console or json, the default level and
+// per package levels given as name=level pairs separated by commas, e.g.
+// main=debug,mdcapnp=trace.
+func Configure(format string, level string, packageLevels string) error {
+	var out io.Writer
+	switch format {
+	case "console":
+		out = newConsoleWriter()
+	case "json":
+		out = os.Stderr
+	default:
+		return fmt.Errorf("unknown log format %s, want console or json", format)
+	}
+
+	defaultLevel, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	levels := make(map[string]zerolog.Level)
+	for _, pair := range strings.Split(packageLevels, ",") {
+		if pair == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid package level '%s', want name=level", pair)
+		}
+
+		levels[name], err = zerolog.ParseLevel(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for name := range levels {
+		if _, ok := entries[name]; !ok {
+			return fmt.Errorf("unknown logger %s, available: %s", name, names())
+		}
+	}
+
+	base = zerolog.New(out).With().Timestamp().Logger()
+	for name, e := range entries {
+		level, ok := levels[name]
+		if !ok {
+			level = defaultLevel
+			if e.internal {
+				level = zerolog.Disabled
+			}
+		}
+
+		*e.logger = base.Level(level).With().Str("pkg", name).Logger()
+	}
+
+	return nil
+}
+
+// newConsoleWriter writes to stderr, with colors only if it is a terminal.
+func newConsoleWriter() zerolog.ConsoleWriter {
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+
+	info, err := os.Stderr.Stat()
+	return zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: time.RFC3339Nano,
+		NoColor:    err != nil || info.Mode()&os.ModeCharDevice == 0,
+	}
+}
+
+func names() string {
+	var list []string
+	for name := range entries {
+		list = append(list, name)
+	}
+
+	slices.Sort(list)
+	return strings.Join(list, ", ")
+}
@@ -1,41 +1,148 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"proxy-bench/logx"
+	"proxy-bench/metrics"
 	"proxy-bench/netx"
+	"proxy-bench/shapenet"
+	"proxy-bench/tracex"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var logger = logx.New("main")
+
 type Args struct {
 	Listen   string
 	Connect  string
 	CertPath string
 	KeyPath  string
 	CAPath   string
+
+	// ClientCAPath makes listeners require client certificates signed by
+	// this CA, ClientCertPath and ClientKeyPath are presented when
+	// connecting.
+	ClientCAPath   string
+	ClientCertPath string
+	ClientKeyPath  string
+	// CertReload is how often certificate files are checked for changes.
+	CertReload time.Duration
+	TLS        TLSParams
+	// Pins restrict which servers client sessions trust, nil if none.
+	Pins *certPins
+
+	// ListenToken is required from clients when listening, ConnectToken is
+	// presented when connecting. Only schemes in tokenSchemes support them.
+	ListenToken  string
+	ConnectToken string
+	// ListenScope limits the proxy capability each client login gets,
+	// ConnectScope restricts the one got when connecting further. Only
+	// schemes in scopeSchemes support them.
+	ListenScope  netx.Scope
+	ConnectScope netx.Scope
+	// Admission admits the streams accepted when listening, nil to accept
+	// all.
+	Admission netx.Admission
+	// KeepAlive is how sessions ping their peers, on both sides.
+	KeepAlive netx.KeepAlive
+
+	// ListenShape and ConnectShape are the faults to inject beneath the
+	// transport, parsed from the shape modifier.
+	ListenShape  *shapenet.Config
+	ConnectShape *shapenet.Config
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		runGenCert(os.Args[2:])
+		return
+	}
+
 	listen := flag.String("listen", "tcp://127.0.0.1:1443", fmt.Sprintf("Listen address, available schemes: %s, add tls to enable TLS, e.g. tcp+tls", getAvailableListenSchemes()))
 	connect := flag.String("connect", "tcp://127.0.0.1:", fmt.Sprintf("Connect address, available schemes: %s, add tls to enable TLS, e.g. tcp+tls", getAvailableConnectSchemes()))
 	certPath := flag.String("cert", "./server-cert.pem", "Cert path for listening")
 	keyPath := flag.String("key", "./server-key.pem", "Key path for listening")
 	caPath := flag.String("ca", "./ca.pem", "CA cert path for connecting")
+	clientCAPath := flag.String("client-ca", "", "Require client certificates signed by this CA when listening")
+	clientCertPath := flag.String("client-cert", "", "Client cert path presented when connecting")
+	clientKeyPath := flag.String("client-key", "", "Client key path presented when connecting")
+	tlsMinVersion := flag.String("tls-min-version", "", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3, Go's default if empty")
+	tlsMaxVersion := flag.String("tls-max-version", "", "Maximum TLS version: 1.0, 1.1, 1.2 or 1.3, Go's default if empty")
+	tlsCiphers := flag.String("tls-ciphers", "", "Comma separated TLS 1.2 cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, Go's default if empty")
+	tlsCurves := flag.String("tls-curves", "", "Comma separated key exchanges by preference: X25519MLKEM768, X25519, P256, P384, P521, Go's default if empty")
+	tlsNoTickets := flag.Bool("tls-no-tickets", false, "Disable TLS session resumption on the listen side")
+	tlsSessionCache := flag.Int("tls-session-cache", 64, "Size of the TLS client session cache shared by all connect side handshakes, 0 disables resumption")
+	tlsServerName := flag.String("tls-server-name", "", "SNI and name to verify when connecting, the connect address host by default")
+	pinSPKI := flag.String("pin-spki", "", "Comma separated SHA-256 hashes of server public keys to trust when connecting, base64 or hex, gencert logs them")
+	pinCert := flag.String("pin-cert", "", "Comma separated SHA-256 fingerprints of server certificates to trust when connecting, base64 or hex")
+	pinOnly := flag.Bool("pin-only", false, "Trust pinned servers without CA validation, for self-signed endpoints")
+	listenToken := flag.String("listen-token", "", fmt.Sprintf("Token clients must authenticate with when listening, @file reads it from a file, available schemes: %s", getTokenSchemes()))
+	connectToken := flag.String("connect-token", "", "Token to authenticate with when connecting, @file reads it from a file")
+	listenScope := flag.String("listen-scope", "", fmt.Sprintf("Limits of the proxy capability each client login gets when listening, e.g. streams=4,bytes=1G, available schemes: %s", getScopeSchemes()))
+	connectScope := flag.String("connect-scope", "", "Restrict the proxy capability got when connecting to these limits, e.g. streams=4,bytes=1G")
+	rateStream := flag.String("rate-stream", "", "Limit every relayed stream to this many bytes per second in each direction, e.g. 10M")
+	rateSession := flag.String("rate-session", "", "Limit the streams of each client session together, those with the same remote address, to this many bytes per second in each direction")
+	rateGlobal := flag.String("rate-global", "", "Limit all relayed streams together to this many bytes per second in each direction")
+	rateBurst := flag.Duration("rate-burst", 50*time.Millisecond, "How long rate limited streams may send at full speed after being idle")
+	maxStreams := flag.Int("max-streams", 0, "Relay at most this many streams at once, 0 is unlimited")
+	maxStreamsPerRemote := flag.Int("max-streams-per-remote", 0, "Relay at most this many streams at once from one remote host, 0 is unlimited")
+	admissionQueue := flag.Int("admission-queue", 128, fmt.Sprintf("How many streams over -max-streams or -max-streams-per-remote may wait for a slot, others are rejected right away. Schemes signaling the rejection to the opener: %s, others close the stream", getAdmissionSchemes()))
+	admissionTimeout := flag.Duration("admission-timeout", time.Second, "How long streams wait for a slot before being rejected")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "Ping the peers of sessions this often, TCP keepalive probes included, 0 disables it")
+	keepAliveTimeout := flag.Duration("keepalive-timeout", 10*time.Second, "Close connections whose peer doesn't answer a ping within this")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close relayed streams which sent nothing in either direction for this long, 0 disables it")
+	certReload := flag.Duration("cert-reload", 10*time.Second, "Check the cert and key files for changes this often and serve new certificates without restarting, 0 to only reload on SIGHUP")
 	pprof := flag.Bool("pprof", false, "Enable pprof profiling")
+	metricsAddress := flag.String("metrics", "", "Serve Prometheus metrics on this address under /metrics, e.g. :9090")
+	status := flag.Bool("status", false, "Print a status line with throughput, streams, goroutines and CPU usage every second")
+	accessLogPath := flag.String("access-log", "", "Append one JSON line per relayed stream to this file, - for stdout")
+	splice := flag.Bool("splice", true, "Relay between plain tcp streams with splice(2), false to copy through user space like all other transports do")
+	writeTo := flag.Bool("write-to", true, "Relay the payloads received by capnp, mdcapnp and grpc streams straight to the other stream and copy through pooled buffers otherwise, false to copy through a buffer per stream and direction like io.Copy")
+	tracePath := flag.String("trace", "", "Append spans of stream lifecycles and transport calls to this file in OTLP JSON")
+	traceSample := flag.Float64("trace-sample", 1, "Ratio of streams to trace, from 0 to 1")
+	bench := flag.Bool("bench", false, "Run an echo server on the connect address and push load through the listen address, all in this process")
+	benchStreams := flag.Int("bench-streams", 8, "Number of parallel streams in bench mode")
+	benchSize := flag.String("bench-size", "64M", "Bytes sent per stream in bench mode")
+	benchChunk := flag.String("bench-chunk", "32K", "Write size in bench mode")
+	benchHandshake := flag.Int("bench-handshake", 0, "Instead of throughput, measure opening this many streams on the connect transport alone, with full and resumed TLS handshakes and on a single session")
+	benchProfile := flag.String("bench-profile", "", "Capture profiles of the bench run into a directory named after the transports and parameters below this one")
+	benchProfileList := flag.String("bench-profiles", strings.Join(benchProfiles, ","), "Profiles captured with -bench-profile")
+	logFormat := flag.String("log-format", "console", "Log format: console or json")
+	logLevel := flag.String("log-level", "info", "Log level: trace, debug, info, warn, error or disabled")
+	logLevels := flag.String("log-levels", "", "Log levels per package, e.g. main=debug,muxnet=debug,mdcapnp=trace. Internal logs of dependencies like mdcapnp are only enabled here")
 	flag.Parse()
 
+	err := logx.Configure(*logFormat, *logLevel, *logLevels)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure logging")
+	}
+
 	fmt.Println("Listen:", *listen)
 	fmt.Println("Connect:", *connect)
 	fmt.Println("Cert:", *certPath)
 	fmt.Println("Key:", *keyPath)
 	fmt.Println("CA:", *caPath)
+	fmt.Println("Client CA:", *clientCAPath)
+	fmt.Println("Client cert:", *clientCertPath)
 	fmt.Println("Pprof:", *pprof)
+	fmt.Println("Metrics:", *metricsAddress)
+	fmt.Println("Access log:", *accessLogPath)
+	fmt.Println("Trace:", *tracePath)
 	fmt.Println("PID:", os.Getpid())
 
 	args := Args{
@@ -44,71 +151,408 @@ func main() {
 		CertPath: *certPath,
 		KeyPath:  *keyPath,
 		CAPath:   *caPath,
+
+		ClientCAPath:   *clientCAPath,
+		ClientCertPath: *clientCertPath,
+		ClientKeyPath:  *clientKeyPath,
+		CertReload:     *certReload,
+		KeepAlive: netx.KeepAlive{
+			Interval: *keepAlive,
+			Timeout:  *keepAliveTimeout,
+		},
+	}
+	streamIdleTimeout = *idleTimeout
+	spliceEnabled = *splice
+	writeToEnabled = *writeTo
+
+	args.TLS, err = parseTLSParams(*tlsMinVersion, *tlsMaxVersion, *tlsCiphers, *tlsCurves)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse TLS parameters")
+	}
+	args.TLS.SessionTicketsDisabled = *tlsNoTickets
+	args.TLS.ServerName = *tlsServerName
+	args.TLS.SessionCacheSize = *tlsSessionCache
+
+	args.Pins, err = parsePins(*pinSPKI, *pinCert, *pinOnly)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse pins")
+	}
+
+	args.ListenToken, err = readToken(*listenToken)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read listen token")
+	}
+	args.ConnectToken, err = readToken(*connectToken)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read connect token")
+	}
+	args.ListenScope, err = parseScope(*listenScope)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse listen scope")
+	}
+	args.ConnectScope, err = parseScope(*connectScope)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse connect scope")
+	}
+
+	rateLimiter, err = parseRateLimits(*rateStream, *rateSession, *rateGlobal, *rateBurst)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse rate limits")
+	}
+	if listenScheme, _, _ := splitAddress(args.Listen); *rateSession != "" && unaddressedSchemes[listenScheme] {
+		logger.Fatal().Str("address", args.Listen).Msg("Session rate limits are not supported by the scheme of listen address")
+	}
+
+	args.Admission, err = newAdmission(*maxStreams, *maxStreamsPerRemote, *admissionQueue, *admissionTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse stream limits")
 	}
 
 	if *pprof {
 		go func() {
-			log.Printf("Starting pprof server on :6060")
+			logger.Info().Str("address", ":6060").Msg("Starting pprof server")
 			if err := http.ListenAndServe(":6060", nil); err != nil {
-				log.Printf("pprof server error: %v", err)
+				logger.Error().Err(err).Msg("pprof server stopped")
 			}
 		}()
 	}
 
-	server := newServerSession(args)
-	client := newClientSession(args)
+	if *accessLogPath != "" {
+		streamLog, err = openAccessLog(*accessLogPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open access log")
+		}
+	}
+
+	if *tracePath != "" {
+		err = tracex.Enable(*tracePath, *traceSample)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open trace file")
+		}
+	}
+
+	if *metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			logger.Info().Str("address", *metricsAddress).Msg("Starting metrics server")
+			if err := http.ListenAndServe(*metricsAddress, mux); err != nil {
+				logger.Error().Err(err).Msg("metrics server stopped")
+			}
+		}()
+	}
+
+	if *status {
+		listenScheme, _, _ := splitAddress(args.Listen)
+		connectScheme, _, _ := splitAddress(args.Connect)
+		go printStatus(os.Stderr, listenScheme, connectScheme)
+	}
+
+	if *bench {
+		size, err := parseByteSize(*benchSize)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to parse bench size")
+		}
+
+		chunk, err := parseByteSize(*benchChunk)
+		if err != nil || chunk <= 0 {
+			logger.Fatal().Str("size", *benchChunk).Msg("Failed to parse bench chunk size")
+		}
+
+		profiles, err := parseProfiles(*benchProfileList)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to parse bench profiles")
+		}
+
+		runBench(args, BenchArgs{
+			Streams:    *benchStreams,
+			Size:       size,
+			ChunkSize:  chunk,
+			ProfileDir: *benchProfile,
+			Profiles:   profiles,
+			Handshakes: *benchHandshake,
+		})
+
+		err = tracex.Shutdown()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to close trace file")
+		}
+		return
+	}
+
+	serveProxy(args, newServerSession(args), newClientSession(args))
+}
+
+func serveProxy(args Args, server netx.ServerSession, client netx.ClientSession) {
+	listenScheme, _, _ := splitAddress(args.Listen)
+	connectScheme, _, _ := splitAddress(args.Connect)
+	accepted := metrics.StreamsAccepted.WithLabelValues(listenScheme)
+	// Schemes in admissionSchemes got args.Admission and admitted the
+	// stream already.
+	var admit netx.Admission
+	if !admissionSchemes[listenScheme] {
+		admit = args.Admission
+	}
 
 	for {
 		down, err := server.AcceptStream()
 		if err != nil {
-			log.Fatalf("Failed to accept downstream: %v", err)
+			logger.Fatal().Err(err).Msg("Failed to accept downstream")
+		}
+
+		accepted.Inc()
+		record := newStreamRecord(listenScheme, connectScheme, down)
+		if admit == nil {
+			go handleStream(client, down, record)
+			continue
 		}
 
-		log.Printf("Accepted new stream from client")
-		go handleStream(client, down)
+		go func() {
+			release, ok := admitStream(admit, down, record.ID)
+			if !ok {
+				return
+			}
+			defer release()
+			record.admitted()
+
+			handleStream(client, down, record)
+		}()
 	}
 }
 
-func handleStream(client netx.ClientSession, down netx.Stream) {
+func handleStream(client netx.ClientSession, down netx.Stream, record *streamRecord) {
+	metrics.ActiveStreams.Inc()
+
+	// The stream span continues the trace of the transport call which
+	// accepted the stream, if there was one.
+	ctx := context.Background()
+	if stream, ok := down.(netx.ContextStream); ok {
+		ctx = stream.Context()
+	}
+	ctx, span := tracex.StartAt(ctx, "stream", tracex.KindServer, record.Start)
+	span.SetAttribute("stream.id", record.ID)
+	span.SetAttribute("listen_scheme", record.ListenScheme)
+	span.SetAttribute("connect_scheme", record.ConnectScheme)
+	if record.AdmissionWaitMS != nil {
+		span.SetAttribute("admission_wait_ms", *record.AdmissionWaitMS)
+	}
+
+	var upCounter, downCounter *countingStream
+	var closeSpan *tracex.Span
+	var wg sync.WaitGroup
+	defer func() {
+		// Runs last, once both directions are done.
+		wg.Wait()
+		record.finish(upCounter, downCounter)
+		err := streamLog.write(record)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to write access log")
+		}
+
+		closeSpan.End()
+		traceRecord(span, record, upCounter, downCounter)
+		span.End()
+
+		metrics.ActiveStreams.Dec()
+		metrics.StreamDuration.Observe(time.Since(record.Start).Seconds())
+	}()
+
 	defer down.Close()
 
-	up, err := client.OpenStream()
+	scheme := record.ConnectScheme
+	openStart := time.Now()
+	openCtx, openSpan := tracex.StartAt(ctx, "open", tracex.KindClient, openStart)
+	upStream, err := openStream(openCtx, client)
+	metrics.OpenStreamDuration.WithLabelValues(scheme).Observe(time.Since(openStart).Seconds())
+	openSpan.SetError(err)
+	openSpan.End()
 	if err != nil {
-		log.Printf("Failed to open upstream: %v", err)
+		logger.Warn().Err(err).Uint64("stream", record.ID).Msg("Failed to open upstream")
+		metrics.StreamsFailed.WithLabelValues(scheme, "open").Inc()
+		record.CloseReason = "open_failed"
+		record.Error = err.Error()
 		return
 	}
 
-	log.Printf("Success to open new stream to server")
+	logger.Debug().Uint64("stream", record.ID).Msg("Success to open upstream")
+	metrics.StreamsOpened.WithLabelValues(scheme).Inc()
+	record.UpLocalAddr, record.UpRemoteAddr = streamAddrs(upStream)
 
-	defer up.Close()
+	defer upStream.Close()
+
+	// Transport calls made for the stream from now on are traced below it.
+	for _, stream := range []netx.Stream{down, upStream} {
+		if stream, ok := stream.(netx.ContextStream); ok {
+			stream.SetContext(ctx)
+		}
+	}
+
+	limitedUp, limitedDown, releaseLimits := rateLimiter.limitStreams(upStream, down, record.DownRemoteAddr)
+	defer releaseLimits()
+	defer limitedDown.Close()
+	defer limitedUp.Close()
+
+	upCounter = newCountingStream(limitedUp, metrics.Bytes.WithLabelValues("upstream"))
+	downCounter = newCountingStream(limitedDown, metrics.Bytes.WithLabelValues("downstream"))
+
+	// Closing both streams ends both directions of the relay.
+	idle := newIdleTimer(streamIdleTimeout, func() {
+		logger.Debug().Uint64("stream", record.ID).Msg("Closing idle stream")
+		limitedDown.Close()
+		limitedUp.Close()
+	})
+	defer idle.stop()
+	upCounter.idle = idle
+	downCounter.idle = idle
+
+	// The first direction to finish decides the close reason, and a stream
+	// counts as failed once even if both directions fail.
+	var first, failed sync.Once
+	relay := func(src netx.Stream, dst *countingStream, srcName, dstName string) {
+		_, relaySpan := tracex.Start(ctx, "relay "+srcName+" -> "+dstName, tracex.KindInternal)
+		written, err := copyStream(src, dst, srcName, dstName, record.ID)
+		if idle.expired() {
+			err = errIdleTimeout
+		}
+		relaySpan.SetAttribute("bytes", written)
+		relaySpan.SetError(err)
+		relaySpan.End()
+
+		first.Do(func() {
+			record.setClosed(srcName, err)
+			// Closing lasts until the other direction is done too.
+			_, closeSpan = tracex.Start(ctx, "close", tracex.KindInternal)
+			closeSpan.SetAttribute("first_closed", srcName)
+			closeSpan.SetAttribute("close_reason", record.CloseReason)
+		})
+		if err != nil {
+			failed.Do(metrics.StreamsFailed.WithLabelValues(scheme, "copy").Inc)
+		}
+	}
 
 	// down -> up
-	go copyStream(down, up, "downstream", "upstream")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		relay(down, upCounter, "downstream", "upstream")
+	}()
 
 	// up -> down
-	copyStream(up, down, "upstream", "downstream")
+	relay(upStream, downCounter, "upstream", "downstream")
+}
+
+// openStream passes ctx on to the client session if it takes one.
+func openStream(ctx context.Context, client netx.ClientSession) (netx.Stream, error) {
+	if opener, ok := client.(netx.ContextOpener); ok {
+		return opener.OpenStreamContext(ctx)
+	}
+
+	return client.OpenStream()
+}
+
+// traceRecord adds the outcome of a finished stream to its span.
+func traceRecord(span *tracex.Span, record *streamRecord, up, down *countingStream) {
+	span.SetAttribute("bytes_up", record.BytesUp)
+	span.SetAttribute("bytes_down", record.BytesDown)
+	span.SetAttribute("close_reason", record.CloseReason)
+	if record.Error != "" {
+		span.SetError(errors.New(record.Error))
+	}
+
+	addFirstByte(span, "first byte to upstream", up)
+	addFirstByte(span, "first byte to downstream", down)
+}
+
+func addFirstByte(span *tracex.Span, name string, stream *countingStream) {
+	if stream == nil {
+		return
+	}
+	if first := stream.firstWrite.Load(); first != 0 {
+		span.AddEventAt(name, time.Unix(0, first))
+	}
+}
+
+// countingStream counts the bytes written to it and remembers when the first
+// ones were. Writes touch idle, if set.
+type countingStream struct {
+	netx.Stream
+	counter    prometheus.Counter
+	written    atomic.Int64
+	firstWrite atomic.Int64
+	idle       *idleTimer
+}
+
+func newCountingStream(stream netx.Stream, counter prometheus.Counter) *countingStream {
+	return &countingStream{
+		Stream:  stream,
+		counter: counter,
+	}
+}
+
+func (s *countingStream) Write(p []byte) (n int, err error) {
+	n, err = s.Stream.Write(p)
+	s.count(int64(n))
+	return
+}
+
+func (s *countingStream) count(n int64) {
+	if n > 0 && s.written.Add(n) == n {
+		s.firstWrite.Store(time.Now().UnixNano())
+	}
+	s.counter.Add(float64(n))
+	s.idle.touch()
+}
+
+// ReadFrom relays plain TCP to plain TCP with splice(2), see spliceFrom, and
+// copies like netx.ReadFrom otherwise.
+func (s *countingStream) ReadFrom(r io.Reader) (int64, error) {
+	if src, dst, ok := s.spliceConns(r); ok {
+		return s.spliceFrom(src, dst)
+	}
+
+	if !writeToEnabled {
+		return io.Copy(netx.WriterOnly{Writer: s}, r)
+	}
+	return netx.ReadFrom(s, r)
+}
+
+// writeToEnabled is whether relays use the io.WriterTo of their source
+// stream and pooled buffers.
+var writeToEnabled = true
+
+// readerOnly hides the WriteTo of a reader from io.Copy.
+type readerOnly struct {
+	io.Reader
 }
 
-func copyStream(src, dst netx.Stream, srcName, dstName string) (written int64, copyErr error) {
-	written, copyErr = io.Copy(dst, src)
+func copyStream(src, dst netx.Stream, srcName, dstName string, id uint64) (written int64, copyErr error) {
+	// The ReadFrom of countingStream decides on its own, see there.
+	var r io.Reader = src
+	var w io.Writer = dst
+	if !writeToEnabled {
+		if _, ok := src.(io.WriterTo); ok {
+			r = readerOnly{src}
+		}
+		if _, ok := dst.(*countingStream); !ok {
+			w = netx.WriterOnly{Writer: dst}
+		}
+	}
+
+	written, copyErr = io.Copy(w, r)
 	if copyErr != nil {
-		log.Printf("Failed to copy %s -> %s(written=%d): %v", srcName, dstName, written, copyErr)
+		logger.Debug().Err(copyErr).Uint64("stream", id).Int64("written", written).Msgf("Failed to copy %s -> %s", srcName, dstName)
 	} else {
-		log.Printf("Success to copy %s -> %s(written=%d)", srcName, dstName, written)
+		logger.Debug().Uint64("stream", id).Int64("written", written).Msgf("Success to copy %s -> %s", srcName, dstName)
 	}
 
 	err := src.CloseRead()
 	if err != nil {
-		log.Printf("Failed to close read end of %s: %v", srcName, err)
-	} else {
-		log.Printf("Success to close read end of %s", srcName)
+		logger.Debug().Err(err).Uint64("stream", id).Msgf("Failed to close read end of %s", srcName)
 	}
 
 	err = dst.CloseWrite()
 	if err != nil {
-		log.Printf("Failed to close write end of %s: %v", dstName, err)
-	} else {
-		log.Printf("Success to close write end of %s", dstName)
+		logger.Debug().Err(err).Uint64("stream", id).Msgf("Failed to close write end of %s", dstName)
 	}
 
 	return
@@ -122,12 +566,32 @@ func newServerSession(args Args) netx.ServerSession {
 	network, _, _ := splitAddress(args.Listen)
 	creator, ok := serverSessionCreators[network]
 	if !ok || creator == nil {
-		log.Fatalf("Unknown scheme of listen address: %s", args.Listen)
+		logger.Fatal().Str("address", args.Listen).Msg("Unknown scheme of listen address")
+	}
+
+	if args.ListenToken != "" && !tokenSchemes[network] {
+		logger.Fatal().Str("address", args.Listen).Msg("Token authentication is not supported by the scheme of listen address")
+	}
+	if args.ListenScope != (netx.Scope{}) && !scopeSchemes[network] {
+		logger.Fatal().Str("address", args.Listen).Msg("Scopes are not supported by the scheme of listen address")
+	}
+
+	listen, shape, streamLayer, err := parseShapeAddress(args.Listen)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse listen address")
+	}
+	args.Listen = listen
+	if !streamLayer {
+		args.ListenShape = shape
 	}
 
 	session, err := creator(args)
 	if err != nil {
-		log.Fatalf("Failed to create server session: %v", err)
+		logger.Fatal().Err(err).Msg("Failed to create server session")
+	}
+
+	if streamLayer {
+		return shapenet.WrapServerSession(session, *shape)
 	}
 
 	return session
@@ -151,12 +615,32 @@ func newClientSession(args Args) netx.ClientSession {
 	network, _, _ := splitAddress(args.Connect)
 	creator, ok := clientSessionCreators[network]
 	if !ok || creator == nil {
-		log.Fatalf("Unknown scheme of connect address: %s", network)
+		logger.Fatal().Str("address", args.Connect).Msg("Unknown scheme of connect address")
+	}
+
+	if args.ConnectToken != "" && !tokenSchemes[network] {
+		logger.Fatal().Str("address", args.Connect).Msg("Token authentication is not supported by the scheme of connect address")
+	}
+	if args.ConnectScope != (netx.Scope{}) && !scopeSchemes[network] {
+		logger.Fatal().Str("address", args.Connect).Msg("Scopes are not supported by the scheme of connect address")
+	}
+
+	connect, shape, streamLayer, err := parseShapeAddress(args.Connect)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to parse connect address")
+	}
+	args.Connect = connect
+	if !streamLayer {
+		args.ConnectShape = shape
 	}
 
 	session, err := creator(args)
 	if err != nil {
-		log.Fatalf("Failed to create client session: %v", err)
+		logger.Fatal().Err(err).Msg("Failed to create client session")
+	}
+
+	if streamLayer {
+		return shapenet.WrapClientSession(session, *shape)
 	}
 
 	return session
@@ -175,15 +659,55 @@ func getAvailableConnectSchemes() string {
 func splitAddress(s string) (network string, tls bool, addr string) {
 	parts := strings.SplitN(s, "://", 2)
 	if len(parts) != 2 {
-		log.Panicf("Failed to split scheme and address from '%s': '://' not found", s)
+		logger.Panic().Str("address", s).Msg("Failed to split scheme and address: '://' not found")
 	}
 	addr = parts[1]
 
-	schemes := strings.SplitN(parts[0], "+", 2)
+	schemes := strings.Split(parts[0], "+")
 	network = schemes[0]
-	if len(schemes) == 2 && schemes[1] == "tls" {
-		tls = true
-	}
+	tls = slices.Contains(schemes[1:], "tls")
 
 	return
 }
+
+// hasModifier reports whether the scheme of s has the given modifier, e.g. mem
+// for capnp+tls+mem://name.
+func hasModifier(s string, modifier string) bool {
+	scheme, _, _ := strings.Cut(s, "://")
+	return slices.Contains(strings.Split(scheme, "+")[1:], modifier)
+}
+
+// withoutModifier returns s with the given modifier removed from its scheme.
+func withoutModifier(s string, modifier string) string {
+	scheme, rest, _ := strings.Cut(s, "://")
+	parts := strings.Split(scheme, "+")
+	modifiers := slices.DeleteFunc(parts[1:], func(part string) bool {
+		return part == modifier
+	})
+
+	return strings.Join(append(parts[:1], modifiers...), "+") + "://" + rest
+}
+
+// parseByteSize parses a byte count with an optional K, M or G suffix, which
+// are powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * multiplier, nil
+}
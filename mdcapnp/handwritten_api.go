@@ -2,6 +2,10 @@ package mdcapnp
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+
+	netx "proxy-bench/netx"
 
 	rpc "matheusd.com/mdcapnp/capnprpc"
 	ser "matheusd.com/mdcapnp/capnpser"
@@ -32,6 +36,65 @@ func (p Proxy) OpenStream(down rpc.CallHandler) ByteStream {
 	))
 }
 
+const Proxy_Restrict_MethodId = 0x2002
+
+var restrictRequestSize = ser.StructSize{DataSectionSize: 0, PointerSectionSize: 1}
+
+type restrictRequestBuilder ser.StructBuilder
+
+// SetScope sets the scope as Data, MaxStreams and MaxBytes in little endian.
+func (b *restrictRequestBuilder) SetScope(scope netx.Scope) error {
+	data := binary.LittleEndian.AppendUint32(nil, scope.MaxStreams)
+	data = binary.LittleEndian.AppendUint64(data, scope.MaxBytes)
+	return (*ser.StructBuilder)(b).SetData(0, data)
+}
+
+type RestrictRequest ser.Struct
+
+func (s *RestrictRequest) Scope() (netx.Scope, error) {
+	data := []byte((*ser.Struct)(s).Data(0))
+	if len(data) != 12 {
+		return netx.Scope{}, errors.New("invalid scope")
+	}
+
+	return netx.Scope{
+		MaxStreams: binary.LittleEndian.Uint32(data),
+		MaxBytes:   binary.LittleEndian.Uint64(data[4:]),
+	}, nil
+}
+
+// Restrict returns a Proxy limited to scope within this one's.
+func (p Proxy) Restrict(scope netx.Scope) Proxy {
+	vSerSize, _ := ser.ByteCount(12).StorageWordCount()
+	cs, req := rpc.SetupCallWithStructParamsGeneric[restrictRequestBuilder](
+		rpc.CallFuture(p),
+		restrictRequestSize.TotalSize()+vSerSize,
+		Proxy_InterfaceId,
+		Proxy_Restrict_MethodId,
+		restrictRequestSize,
+	)
+
+	req.SetScope(scope)
+
+	return Proxy(rpc.RemoteCall(
+		rpc.CallFuture(p),
+		cs,
+	))
+}
+
+const Proxy_Ping_MethodId = 0x2003
+
+// Ping is answered right away, it tells whether the connection is alive.
+func (p Proxy) Ping() rpc.VoidFuture {
+	return rpc.VoidFuture(rpc.RemoteCall(
+		rpc.CallFuture(p),
+		rpc.SetupCallNoParams(rpc.CallFuture(p),
+			Proxy_InterfaceId,
+			Proxy_Ping_MethodId,
+		),
+	))
+}
+
 const ByteStream_InterfaceId = 0x1701d
 
 type ByteStream rpc.CallFuture
@@ -93,3 +156,47 @@ func (bs ByteStream) End() rpc.VoidFuture {
 		),
 	))
 }
+
+const Login_InterfaceId = 0x1701e
+
+// Login is the bootstrap capability, it hands out the Proxy for the right
+// token.
+type Login rpc.CallFuture
+
+func LoginAsRemoteVatBootstrap(rv rpc.RemoteVat) Login {
+	return Login(rv.Bootstrap())
+}
+
+var authenticateRequestSize = ser.StructSize{DataSectionSize: 0, PointerSectionSize: 1}
+
+type authenticateRequestBuilder ser.StructBuilder
+
+func (b *authenticateRequestBuilder) SetToken(token []byte) error {
+	return (*ser.StructBuilder)(b).SetData(0, token)
+}
+
+type AuthenticateRequest ser.Struct
+
+func (s *AuthenticateRequest) Token() []byte {
+	return []byte((*ser.Struct)(s).Data(0))
+}
+
+const Login_Authenticate_MethodId = 0x3001
+
+func (l Login) Authenticate(token []byte) Proxy {
+	vSerSize, _ := ser.ByteCount(len(token)).StorageWordCount()
+	cs, req := rpc.SetupCallWithStructParamsGeneric[authenticateRequestBuilder](
+		rpc.CallFuture(l),
+		authenticateRequestSize.TotalSize()+vSerSize,
+		Login_InterfaceId,
+		Login_Authenticate_MethodId,
+		authenticateRequestSize,
+	)
+
+	req.SetToken(token)
+
+	return Proxy(rpc.RemoteCall(
+		rpc.CallFuture(l),
+		cs,
+	))
+}
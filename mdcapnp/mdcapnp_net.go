@@ -1,28 +1,34 @@
 package mdcapnp
 
 import (
+	"cmp"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"proxy-bench/logx"
+	"proxy-bench/metrics"
 	netx "proxy-bench/netx"
+	"proxy-bench/tracex"
 
-	"github.com/rs/zerolog"
 	rpc "matheusd.com/mdcapnp/capnprpc"
 )
 
-var logger zerolog.Logger = /*zerolog.New(os.Stderr)*/ zerolog.Nop()
+// logger is for the internals of the mdcapnp rpc package, enable it with
+// -log-levels mdcapnp=debug.
+var logger = logx.NewInternal("mdcapnp")
 
 // byteStreamServer is an implementation of a capability server that provides
 // the ByteStream capability. This is a low-level implementation.
 type byteStreamServer struct {
-	pipeReader io.ReadCloser
-	pipeWriter io.WriteCloser
+	pipeReader *netx.PipeReader
+	pipeWriter *netx.PipeWriter
+	quota      *netx.Quota
 }
 
 func (s *byteStreamServer) Call(ctx context.Context, cc *rpc.CallContext) error {
@@ -35,6 +41,10 @@ func (s *byteStreamServer) Call(ctx context.Context, cc *rpc.CallContext) error
 		if err != nil {
 			return err
 		}
+		err = s.quota.Use(len(req.Data()))
+		if err != nil {
+			return err
+		}
 		_, err = s.pipeWriter.Write(req.Data())
 		return err
 	case ByteStream_End_MethodId:
@@ -45,7 +55,7 @@ func (s *byteStreamServer) Call(ctx context.Context, cc *rpc.CallContext) error
 }
 
 func newByteStreamServer() *byteStreamServer {
-	pr, pw := io.Pipe()
+	pr, pw := netx.Pipe()
 	return &byteStreamServer{
 		pipeReader: pr,
 		pipeWriter: pw,
@@ -59,21 +69,79 @@ func newByteStreamServer() *byteStreamServer {
 type streamImpl struct {
 	bsClient ByteStream
 	bsServer *byteStreamServer
+	ctx      context.Context
+	released atomic.Bool
+	// release gives back the slot the stream was admitted to on the server
+	// side, nil on the client side.
+	release func()
+}
+
+func newStreamImpl(ctx context.Context, bsClient ByteStream, bsServer *byteStreamServer) *streamImpl {
+	return &streamImpl{
+		bsClient: bsClient,
+		bsServer: bsServer,
+		ctx:      ctx,
+	}
+}
+
+func (s *streamImpl) Context() context.Context {
+	return s.ctx
+}
+
+func (s *streamImpl) SetContext(ctx context.Context) {
+	s.ctx = ctx
 }
 
 func (s *streamImpl) Read(p []byte) (n int, err error) {
 	return s.bsServer.pipeReader.Read(p)
 }
 
+// WriteTo lets io.Copy write the data of incoming Write calls straight to its
+// destination.
+func (s *streamImpl) WriteTo(w io.Writer) (n int64, err error) {
+	return s.bsServer.pipeReader.WriteTo(w)
+}
+
+// maxWriteSize is the most bytes a Write call carries, so whole payloads
+// relayed from other transports don't turn into messages of any size.
+const maxWriteSize = 1024 * 1024
+
 func (s *streamImpl) Write(p []byte) (n int, err error) {
-	err = s.bsClient.Write(p).Wait(context.Background())
-	n = len(p)
-	return
+	err = s.bsServer.quota.Use(len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	_, span := tracex.Start(s.ctx, "mdcapnp.Write", tracex.KindClient)
+	span.SetAttribute("bytes", len(p))
+	defer span.End()
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxWriteSize)]
+		err = s.bsClient.Write(chunk).Wait(context.Background())
+		if err != nil {
+			span.SetError(err)
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
 }
 
 func (s *streamImpl) Close() error {
 	err1 := s.bsServer.pipeReader.Close()
+	_, span := tracex.Start(s.ctx, "mdcapnp.End", tracex.KindClient)
 	err2 := s.bsClient.End().Wait(context.Background())
+	span.SetError(err2)
+	span.End()
+	if s.released.CompareAndSwap(false, true) {
+		s.bsServer.quota.CloseStream()
+		if s.release != nil {
+			s.release()
+		}
+	}
 	return errors.Join(err1, err2)
 }
 
@@ -87,6 +155,9 @@ func (s *streamImpl) CloseWrite() error {
 
 type ServerSession struct {
 	listener   net.Listener
+	token      string
+	scope      netx.Scope
+	admit      netx.Admission
 	nextStream chan netx.Stream
 
 	v       *rpc.Vat
@@ -95,8 +166,14 @@ type ServerSession struct {
 	runChan chan error
 }
 
-// Call implements the server side of the Proxy capability interface.
-func (s *ServerSession) Call(ctx context.Context, cc *rpc.CallContext) error {
+// proxyServer implements the server side of the Proxy capability interface,
+// its streams count against quota.
+type proxyServer struct {
+	s     *ServerSession
+	quota *netx.Quota
+}
+
+func (p *proxyServer) Call(ctx context.Context, cc *rpc.CallContext) error {
 	if cc.InterfaceId() != Proxy_InterfaceId {
 		return fmt.Errorf("unknown interface")
 	}
@@ -105,20 +182,84 @@ func (s *ServerSession) Call(ctx context.Context, cc *rpc.CallContext) error {
 		// This is the server, processing OpenStream(). 'down' is the
 		// argument (cap sent by the client), 'up' is the return (cap
 		// sent by the server).
+		ctx, span := tracex.Start(context.WithoutCancel(ctx), "mdcapnp.OpenStream", tracex.KindServer)
+		defer span.End()
+
 		down, err := rpc.CallContextParamsCapability[ByteStream](cc)
 		if err != nil {
+			span.SetError(err)
 			return fmt.Errorf("unable to get 'down' arg: %v", err)
 		}
+		err = p.quota.OpenStream()
+		if err != nil {
+			span.SetError(err)
+			return err
+		}
+		// The call context doesn't tell the connection, so streams
+		// are only limited in total.
+		release, err := p.s.admit.Admit(ctx, nil)
+		if err != nil {
+			p.quota.CloseStream()
+			span.SetError(err)
+			return err
+		}
 		up := newByteStreamServer()
+		up.quota = p.quota
+		stream := newStreamImpl(ctx, down, up)
+		stream.release = release
 		go func() {
 			// Alert main of the next stream.
-			s.nextStream <- &streamImpl{
-				bsClient: down,
-				bsServer: up,
-			}
+			p.s.nextStream <- stream
 		}()
 		return cc.RespondAsSenderHostedCap(up)
 
+	case Proxy_Restrict_MethodId:
+		req, err := rpc.CallContextParamsStruct[RestrictRequest](cc)
+		if err != nil {
+			return err
+		}
+		scope, err := req.Scope()
+		if err != nil {
+			return err
+		}
+		return cc.RespondAsSenderHostedCap(&proxyServer{
+			s:     p.s,
+			quota: netx.NewQuota(scope, p.quota),
+		})
+
+	case Proxy_Ping_MethodId:
+		return nil
+
+	default:
+		return fmt.Errorf("unknown method")
+	}
+}
+
+// loginServer is the bootstrap capability, it hands out a Proxy capability
+// with its own quota after checking the token.
+type loginServer struct {
+	s *ServerSession
+}
+
+func (l *loginServer) Call(ctx context.Context, cc *rpc.CallContext) error {
+	if cc.InterfaceId() != Login_InterfaceId {
+		return fmt.Errorf("unknown interface")
+	}
+	switch cc.MethodId() {
+	case Login_Authenticate_MethodId:
+		req, err := rpc.CallContextParamsStruct[AuthenticateRequest](cc)
+		if err != nil {
+			return err
+		}
+		if !netx.CheckToken(l.s.token, string(req.Token())) {
+			metrics.AuthRejected.WithLabelValues("mdcapnp").Inc()
+			return netx.ErrUnauthenticated
+		}
+		return cc.RespondAsSenderHostedCap(&proxyServer{
+			s:     l.s,
+			quota: netx.NewQuota(l.s.scope, nil),
+		})
+
 	default:
 		return fmt.Errorf("unknown method")
 	}
@@ -138,11 +279,17 @@ func (s *ServerSession) Close() error {
 	return <-s.runChan
 }
 
-func NewServerSession(listener net.Listener) *ServerSession {
+// NewServerSession serves a Proxy limited to scope to clients authenticating
+// with token, to any client if it's empty. Streams are admitted by admit
+// before openStream returns.
+func NewServerSession(listener net.Listener, token string, scope netx.Scope, admit netx.Admission) *ServerSession {
 	runChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &ServerSession{
 		listener:   listener,
+		token:      token,
+		scope:      scope,
+		admit:      admit,
 		stopRun:    cancel,
 		runChan:    runChan,
 		runCtx:     ctx,
@@ -150,8 +297,8 @@ func NewServerSession(listener net.Listener) *ServerSession {
 	}
 	s.v = rpc.NewVat(
 		rpc.WithName("server"),
-		rpc.WithBootstrapHandler(s),
-		rpc.WithLogger(&logger),
+		rpc.WithBootstrapHandler(&loginServer{s: s}),
+		rpc.WithLogger(logger),
 	)
 	go func() {
 		runChan <- s.v.RunWithListeners(ctx, listener)
@@ -161,9 +308,10 @@ func NewServerSession(listener net.Listener) *ServerSession {
 }
 
 type ClientSession struct {
-	network   string
-	address   string
-	tlsConfig *tls.Config
+	dial      netx.Dialer
+	token     string
+	scope     netx.Scope
+	keepAlive netx.KeepAlive
 	v         *rpc.Vat
 	stopRun   func()
 	runChan   chan error
@@ -173,37 +321,71 @@ type ClientSession struct {
 	conn  net.Conn
 }
 
-func (s *ClientSession) connect() error {
-	var conn net.Conn
-	var err error
-
-	if s.tlsConfig != nil {
-		conn, err = tls.Dial(s.network, s.address, s.tlsConfig)
-	} else {
-		conn, err = net.Dial(s.network, s.address)
-	}
+func (s *ClientSession) connect(ctx context.Context) error {
+	conn, err := s.dial(ctx)
 	if err != nil {
 		return err
 	}
 	rv := s.v.UseRemoteVat(rpc.NewIOTransport(conn.RemoteAddr().String(), conn))
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	proxy := ProxyAsRemoteVatBootstrap(rv)
+	proxy := LoginAsRemoteVatBootstrap(rv).Authenticate([]byte(s.token))
+	if s.scope != (netx.Scope{}) {
+		proxy = proxy.Restrict(s.scope)
+	}
 	_, err = proxy.Wait(ctx)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	s.proxy = proxy
 	s.conn = conn
+	if s.keepAlive.Interval > 0 {
+		go s.keepConnAlive(conn, proxy)
+	}
 	return err
 }
 
+// keepConnAlive pings proxy until conn is closed, and closes it once a ping
+// isn't answered in time, so the next stream reconnects.
+func (s *ClientSession) keepConnAlive(conn net.Conn, proxy Proxy) {
+	ticker := time.NewTicker(s.keepAlive.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		current := s.conn == conn
+		s.mu.Unlock()
+		if !current {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(s.keepAlive.Timeout, s.keepAlive.Interval))
+		err := proxy.Ping().Wait(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to ping, closing connection")
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+	}
+}
+
 func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+func (s *ClientSession) OpenStreamContext(ctx context.Context) (netx.Stream, error) {
 	var err error
 
 	s.mu.Lock()
 	if s.conn == nil {
-		err = s.connect()
+		err = s.connect(ctx)
 	}
 	proxy := s.proxy
 	s.mu.Unlock()
@@ -212,37 +394,47 @@ func (s *ClientSession) OpenStream() (netx.Stream, error) {
 		return nil, err
 	}
 
+	_, span := tracex.Start(ctx, "mdcapnp.OpenStream", tracex.KindClient)
+	defer span.End()
+
 	down := newByteStreamServer()
 	up := proxy.OpenStream(down)
 	_, err = up.Wait(context.Background())
 	if err != nil {
+		span.SetError(err)
 		return nil, err
 	}
 
-	return &streamImpl{
-		bsClient: up,
-		bsServer: down,
-	}, nil
+	return newStreamImpl(context.Background(), up, down), nil
 }
 
 func (s *ClientSession) Close() error {
+	// Stops keepConnAlive.
+	s.mu.Lock()
+	s.conn = nil
+	s.mu.Unlock()
+
 	s.stopRun()
 	return <-s.runChan
 }
 
-func NewClientSession(network, address string, tlsConfig *tls.Config) *ClientSession {
+// NewClientSession authenticates with token on every connection dialed, and
+// restricts the Proxy it gets to scope unless that's unlimited. Connections
+// are pinged as set by keepAlive and dropped if the server stops answering.
+func NewClientSession(dial netx.Dialer, token string, scope netx.Scope, keepAlive netx.KeepAlive) *ClientSession {
 	v := rpc.NewVat(
 		rpc.WithName("client"),
-		rpc.WithLogger(&logger),
+		rpc.WithLogger(logger),
 	)
 	runChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() { runChan <- v.Run(ctx) }()
 
 	return &ClientSession{
-		network:   network,
-		address:   address,
-		tlsConfig: tlsConfig,
+		dial:      dial,
+		token:     token,
+		scope:     scope,
+		keepAlive: keepAlive,
 		stopRun:   cancel,
 		v:         v,
 		runChan:   runChan,
@@ -1,51 +1,30 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
-	"net"
 	"proxy-bench/mdcapnp"
 	"proxy-bench/netx"
 )
 
 func init() {
+	tokenSchemes["mdcapnp"] = true
+	scopeSchemes["mdcapnp"] = true
+	admissionSchemes["mdcapnp"] = true
+	unaddressedSchemes["mdcapnp"] = true
 	serverSessionCreators["mdcapnp"] = func(args Args) (netx.ServerSession, error) {
-		var listener net.Listener
-		var err error
-
-		_, tlsEnabled, addr := splitAddress(args.Listen)
-		if tlsEnabled {
-			tlsConfig, err1 := getServerTLSConfig(args)
-			if err1 != nil {
-				return nil, err1
-			}
-
-			listener, err = tls.Listen("tcp", addr, tlsConfig)
-		} else {
-			listener, err = net.Listen("tcp", addr)
-		}
-
+		listener, err := listenTLSConn(args, "tcp", args.Listen)
 		if err != nil {
 			return nil, err
 		}
 
-		log.Printf("Listened on %s", args.Listen)
-
-		return mdcapnp.NewServerSession(listener), nil
+		return mdcapnp.NewServerSession(listener, args.ListenToken, args.ListenScope, args.Admission), nil
 	}
 
 	clientSessionCreators["mdcapnp"] = func(args Args) (netx.ClientSession, error) {
-		_, tlsEnabled, addr := splitAddress(args.Connect)
-		var tlsConfig *tls.Config
-		var err error
-
-		if tlsEnabled {
-			tlsConfig, err = getClientTLSConfig(args)
-			if err != nil {
-				return nil, err
-			}
+		dial, err := newTLSDialer(args, "tcp", args.Connect)
+		if err != nil {
+			return nil, err
 		}
 
-		return mdcapnp.NewClientSession("tcp", addr, tlsConfig), nil
+		return mdcapnp.NewClientSession(countReconnects("mdcapnp", dial), args.ConnectToken, args.ConnectScope, args.KeepAlive), nil
 	}
 }
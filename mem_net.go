@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"proxy-bench/memnet"
+	"strings"
+	"time"
+)
+
+// isMemAddress reports whether address is in-process, either through the mem
+// scheme (served by the std sessions) or the mem modifier of another
+// transport.
+func isMemAddress(address string) bool {
+	network, _, _ := splitAddress(address)
+	return network == memnet.Network || hasModifier(address, memnet.Network)
+}
+
+// parseMemAddress splits an in-process address into the listener name and the
+// link config given as query, e.g. name?latency=10ms&jitter=2ms&bandwidth=100M&buffer=4M.
+// Only the dialing side's link config is used.
+func parseMemAddress(addr string) (name string, config memnet.LinkConfig, err error) {
+	name, rawQuery, _ := strings.Cut(addr, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", config, err
+	}
+
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "latency":
+			config.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(value)
+		case "bandwidth":
+			config.Bandwidth, err = parseByteSize(value)
+		case "buffer":
+			var size int64
+			size, err = parseByteSize(value)
+			config.BufferSize = int(size)
+		default:
+			err = fmt.Errorf("unknown mem address parameter: %s", key)
+		}
+
+		if err != nil {
+			return "", config, fmt.Errorf("invalid mem address '%s': %w", addr, err)
+		}
+	}
+
+	return name, config, nil
+}
@@ -0,0 +1,397 @@
+package memnet
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Network is the network name of in-process addresses.
+const Network = "mem"
+
+var (
+	registryMu sync.Mutex
+	listeners  = make(map[string]*Listener)
+)
+
+type Addr string
+
+func (a Addr) Network() string {
+	return Network
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+// Listener is an in-process net.Listener registered under a name, which Dial
+// connects to.
+type Listener struct {
+	name     string
+	conns    chan net.Conn
+	closedCh chan struct{}
+	once     sync.Once
+}
+
+func Listen(name string) (*Listener, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := listeners[name]; ok {
+		return nil, &net.OpError{Op: "listen", Net: Network, Addr: Addr(name), Err: syscall.EADDRINUSE}
+	}
+
+	l := &Listener{
+		name:     name,
+		conns:    make(chan net.Conn),
+		closedCh: make(chan struct{}),
+	}
+	listeners[name] = l
+	return l, nil
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closedCh:
+		return nil, &net.OpError{Op: "accept", Net: Network, Addr: Addr(l.name), Err: net.ErrClosed}
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		registryMu.Lock()
+		delete(listeners, l.name)
+		registryMu.Unlock()
+
+		close(l.closedCh)
+	})
+
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return Addr(l.name)
+}
+
+// Dial connects to the listener registered under name. The link config
+// applies to both directions of the connection.
+func Dial(name string, config LinkConfig) (net.Conn, error) {
+	registryMu.Lock()
+	l := listeners[name]
+	registryMu.Unlock()
+
+	refused := &net.OpError{Op: "dial", Net: Network, Addr: Addr(name), Err: syscall.ECONNREFUSED}
+	if l == nil {
+		return nil, refused
+	}
+
+	client, server := Pipe(config)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closedCh:
+		return nil, refused
+	}
+}
+
+// LinkConfig shapes one direction of a connection.
+type LinkConfig struct {
+	// Latency delays every write by a fixed amount before it can be read.
+	Latency time.Duration
+	// Jitter adds a random delay of up to Jitter on top of Latency. Bytes are
+	// never reordered, a late write holds back the ones after it.
+	Jitter time.Duration
+	// Bandwidth caps the bytes per second going through the link, zero
+	// means unlimited.
+	Bandwidth int64
+	// BufferSize is how many bytes may be in flight before writes block.
+	BufferSize int
+}
+
+const defaultBufferSize = 1024 * 1024
+
+// Pipe returns both ends of an in-process connection. Unlike net.Pipe writes
+// are buffered and each direction can be closed on its own.
+func Pipe(config LinkConfig) (*Conn, *Conn) {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultBufferSize
+	}
+
+	up := newLink(config)
+	down := newLink(config)
+	return &Conn{
+		reader: down,
+		writer: up,
+		local:  Addr("client"),
+		remote: Addr("server"),
+	}, &Conn{
+		reader: up,
+		writer: down,
+		local:  Addr("server"),
+		remote: Addr("client"),
+	}
+}
+
+// Conn is one end of a Pipe. Besides net.Conn it has CloseRead and
+// CloseWrite, so it can be used as a netx.Stream directly.
+type Conn struct {
+	reader *link
+	writer *link
+	local  Addr
+	remote Addr
+}
+
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return c.reader.read(p)
+}
+
+func (c *Conn) Write(p []byte) (n int, err error) {
+	return c.writer.write(p)
+}
+
+func (c *Conn) Close() error {
+	return errors.Join(c.CloseWrite(), c.CloseRead())
+}
+
+func (c *Conn) CloseRead() error {
+	c.reader.closeRead()
+	return nil
+}
+
+func (c *Conn) CloseWrite() error {
+	c.writer.closeWrite()
+	return nil
+}
+
+// Reset aborts both directions, like a TCP RST: pending bytes are dropped and
+// reads and writes on either end fail with ECONNRESET.
+func (c *Conn) Reset() error {
+	c.reader.reset()
+	c.writer.reset()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.reader.setDeadline(&c.reader.readDeadline, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writer.setDeadline(&c.writer.writeDeadline, t)
+	return nil
+}
+
+type chunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// link is one direction of a Pipe.
+type link struct {
+	config        LinkConfig
+	mu            sync.Mutex
+	cond          *sync.Cond
+	chunks        []chunk
+	buffered      int
+	wireFree      time.Time
+	writeClosed   bool
+	readClosed    bool
+	wasReset      bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newLink(config LinkConfig) *link {
+	l := &link{
+		config: config,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *link) write(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for n < len(p) {
+		for l.buffered >= l.config.BufferSize && !l.writeClosed && !l.readClosed && !l.wasReset {
+			if expired(l.writeDeadline) {
+				return n, os.ErrDeadlineExceeded
+			}
+			l.wait(l.writeDeadline)
+		}
+		if l.wasReset {
+			return n, &net.OpError{Op: "write", Net: Network, Err: syscall.ECONNRESET}
+		}
+		if l.writeClosed || l.readClosed {
+			return n, &net.OpError{Op: "write", Net: Network, Err: net.ErrClosed}
+		}
+		if expired(l.writeDeadline) {
+			return n, os.ErrDeadlineExceeded
+		}
+
+		size := min(len(p)-n, l.config.BufferSize-l.buffered)
+		data := make([]byte, size)
+		copy(data, p[n:])
+
+		l.chunks = append(l.chunks, chunk{
+			data:      data,
+			deliverAt: l.schedule(size),
+		})
+		l.buffered += size
+		n += size
+		l.cond.Broadcast()
+	}
+
+	return n, nil
+}
+
+// schedule returns when size bytes written now can be read, accounting for
+// the time the bytes queued before them need to go through the link.
+func (l *link) schedule(size int) time.Time {
+	now := time.Now()
+	latency := l.config.Latency
+	if l.config.Jitter > 0 {
+		latency += rand.N(l.config.Jitter)
+	}
+
+	if l.config.Bandwidth <= 0 {
+		return now.Add(latency)
+	}
+
+	if l.wireFree.Before(now) {
+		l.wireFree = now
+	}
+	l.wireFree = l.wireFree.Add(time.Duration(int64(size) * int64(time.Second) / l.config.Bandwidth))
+	return l.wireFree.Add(latency)
+}
+
+func (l *link) read(p []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if l.wasReset {
+			return 0, &net.OpError{Op: "read", Net: Network, Err: syscall.ECONNRESET}
+		}
+		if l.readClosed {
+			return 0, &net.OpError{Op: "read", Net: Network, Err: net.ErrClosed}
+		}
+		if expired(l.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if len(l.chunks) > 0 {
+			deliverAt := l.chunks[0].deliverAt
+			if !time.Now().Before(deliverAt) {
+				break
+			}
+
+			l.wait(earliest(deliverAt, l.readDeadline))
+			continue
+		}
+
+		if l.writeClosed {
+			return 0, io.EOF
+		}
+
+		l.wait(l.readDeadline)
+	}
+
+	for n < len(p) && len(l.chunks) > 0 && !time.Now().Before(l.chunks[0].deliverAt) {
+		front := &l.chunks[0]
+		copied := copy(p[n:], front.data)
+		front.data = front.data[copied:]
+		n += copied
+		if len(front.data) == 0 {
+			l.chunks[0] = chunk{}
+			l.chunks = l.chunks[1:]
+		}
+	}
+
+	l.buffered -= n
+	l.cond.Broadcast()
+	return n, nil
+}
+
+func (l *link) closeWrite() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.writeClosed = true
+	l.cond.Broadcast()
+}
+
+func (l *link) closeRead() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.readClosed = true
+	l.chunks = nil
+	l.buffered = 0
+	l.cond.Broadcast()
+}
+
+func (l *link) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.wasReset = true
+	l.chunks = nil
+	l.buffered = 0
+	l.cond.Broadcast()
+}
+
+func (l *link) setDeadline(deadline *time.Time, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	*deadline = t
+	l.cond.Broadcast()
+}
+
+// wait blocks until the link changes or until is reached. Must be called with
+// l.mu held.
+func (l *link) wait(until time.Time) {
+	if !until.IsZero() {
+		timer := time.AfterFunc(time.Until(until), func() {
+			l.mu.Lock()
+			l.cond.Broadcast()
+			l.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	l.cond.Wait()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.IsZero() || a.Before(b) {
+		return a
+	}
+
+	return b
+}
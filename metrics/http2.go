@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+const (
+	clientPreface   = http2.ClientPreface
+	frameHeaderSize = 9
+)
+
+// CountGRPCFrames counts the HTTP/2 frames going through conn in GRPCFrames.
+// conn must carry plain HTTP/2 from its first byte, client tells which side
+// sends the connection preface.
+func CountGRPCFrames(conn net.Conn, client bool) net.Conn {
+	c := &frameCountingConn{
+		Conn:     conn,
+		received: newFrameCounter("received"),
+		sent:     newFrameCounter("sent"),
+	}
+	if client {
+		c.sent.skip = len(clientPreface)
+	} else {
+		c.received.skip = len(clientPreface)
+	}
+
+	return c
+}
+
+type frameCountingConn struct {
+	net.Conn
+	received *frameCounter
+	sent     *frameCounter
+}
+
+func (c *frameCountingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.received.count(p[:n])
+	return
+}
+
+func (c *frameCountingConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.sent.count(p[:n])
+	return
+}
+
+// frameCounter follows the frame boundaries of one direction. Reads and
+// writes of a net.Conn are not concurrent with themselves, so it needs no
+// lock.
+type frameCounter struct {
+	counters [http2.FrameContinuation + 1]prometheus.Counter
+	unknown  prometheus.Counter
+	skip     int
+	header   [frameHeaderSize]byte
+	headerN  int
+}
+
+func newFrameCounter(direction string) *frameCounter {
+	f := &frameCounter{
+		unknown: GRPCFrames.WithLabelValues(direction, "UNKNOWN"),
+	}
+	for t := range f.counters {
+		f.counters[t] = GRPCFrames.WithLabelValues(direction, http2.FrameType(t).String())
+	}
+
+	return f
+}
+
+func (f *frameCounter) count(p []byte) {
+	for len(p) > 0 {
+		if f.skip > 0 {
+			n := min(f.skip, len(p))
+			f.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		n := copy(f.header[f.headerN:], p)
+		f.headerN += n
+		p = p[n:]
+		if f.headerN < frameHeaderSize {
+			return
+		}
+
+		frameType := f.header[3]
+		if int(frameType) < len(f.counters) {
+			f.counters[frameType].Inc()
+		} else {
+			f.unknown.Inc()
+		}
+
+		f.skip = int(binary.BigEndian.Uint32(f.header[:4]) >> 8)
+		f.headerN = 0
+	}
+}
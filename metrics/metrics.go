@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry holds all proxy metrics plus the Go runtime and process ones.
+var Registry = prometheus.NewRegistry()
+
+var (
+	StreamsAccepted = newCounterVec("proxy_streams_accepted_total", "Streams accepted from the listen side.", "scheme")
+	StreamsOpened   = newCounterVec("proxy_streams_opened_total", "Streams opened to the connect side.", "scheme")
+	StreamsFailed   = newCounterVec("proxy_streams_failed_total", "Streams that failed, by the stage they failed in: open or copy.", "scheme", "stage")
+	Bytes           = newCounterVec("proxy_bytes_total", "Bytes relayed, upstream is from the listen to the connect side.", "direction")
+	Reconnects      = newCounterVec("proxy_reconnects_total", "Connections of multiplexing transports dialed again after the first one.", "scheme")
+	AuthRejected    = newCounterVec("proxy_auth_rejected_total", "Sessions or streams of the listen side rejected for a wrong or missing token.", "scheme")
+
+	ActiveStreams = register(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_active_streams",
+		Help: "Streams currently relayed.",
+	}))
+
+	StreamDuration = register(prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_stream_duration_seconds",
+		Help:    "Time from accepting and admitting a stream until both directions are done.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}))
+
+	OpenStreamDuration = register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_open_stream_duration_seconds",
+		Help:    "Latency of OpenStream on the connect side, including any dial.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"scheme"}))
+
+	CapnpFlowLimiterStalls = register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_capnp_flow_limiter_stalls_total",
+		Help: "Cap'n Proto writes that had to wait for the flow limiter.",
+	}))
+
+	CapnpFlowLimiterWait = register(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_capnp_flow_limiter_wait_seconds_total",
+		Help: "Time Cap'n Proto writes spent waiting for the flow limiter.",
+	}))
+
+	TLSHandshakes = newCounterVec("proxy_tls_handshakes_total", "TLS handshakes of the connect side, resumed or full.", "resumed")
+
+	ThrottledSeconds = newCounterVec("proxy_throttled_seconds_total", "Time writes waited for rate limits, counted against the limit which was the slowest: stream, session or global.", "direction", "limit")
+
+	AdmissionRejected = newCounterVec("proxy_admission_rejected_total", "Streams of the listen side rejected for being over the concurrency limits, by reason: queue_full, timeout or canceled.", "reason")
+
+	GRPCFrames = newCounterVec("proxy_grpc_frames_total", "HTTP/2 frames of gRPC connections by type, e.g. WINDOW_UPDATE.", "direction", "type")
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return register(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labels))
+}
+
+func register[C prometheus.Collector](c C) C {
+	Registry.MustRegister(c)
+	return c
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Value reads the current value of a counter or gauge, for showing it
+// in-process.
+func Value(m prometheus.Metric) float64 {
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		return 0
+	}
+
+	switch {
+	case out.Counter != nil:
+		return out.Counter.GetValue()
+	case out.Gauge != nil:
+		return out.Gauge.GetValue()
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"proxy-bench/muxnet"
+	"proxy-bench/netx"
+)
+
+func init() {
+	serverSessionCreators["mux"] = func(args Args) (netx.ServerSession, error) {
+		listener, err := listenTLSConn(args, "tcp", args.Listen)
+		if err != nil {
+			return nil, err
+		}
+
+		return muxnet.NewServerSession(listener, muxConfig(args)), nil
+	}
+
+	clientSessionCreators["mux"] = func(args Args) (netx.ClientSession, error) {
+		dial, err := newTLSDialer(args, "tcp", args.Connect)
+		if err != nil {
+			return nil, err
+		}
+
+		return muxnet.NewClientSession(countReconnects("mux", dial), muxConfig(args)), nil
+	}
+}
+
+func muxConfig(args Args) muxnet.Config {
+	return muxnet.Config{
+		KeepAliveInterval: args.KeepAlive.Interval,
+		KeepAliveTimeout:  args.KeepAlive.Timeout,
+	}
+}
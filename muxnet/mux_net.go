@@ -0,0 +1,135 @@
+package muxnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"proxy-bench/logx"
+	"proxy-bench/netx"
+	"sync"
+)
+
+var logger = logx.New("muxnet")
+
+type ServerSession struct {
+	listener net.Listener
+	config   Config
+	incoming chan netx.Stream
+	closedCh chan struct{}
+	once     sync.Once
+}
+
+func NewServerSession(listener net.Listener, config Config) *ServerSession {
+	s := &ServerSession{
+		listener: listener,
+		config:   config,
+		incoming: make(chan netx.Stream),
+		closedCh: make(chan struct{}),
+	}
+
+	go s.acceptConns()
+	return s
+}
+
+func (s *ServerSession) acceptConns() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logger.Warn().Err(err).Msg("Mux listener stopped")
+			return
+		}
+
+		logger.Debug().Stringer("remote", conn.RemoteAddr()).Msg("Accepted mux connection")
+		go s.acceptStreams(NewSession(conn, false, s.config))
+	}
+}
+
+func (s *ServerSession) acceptStreams(session *Session) {
+	defer session.Close()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			logger.Debug().Err(err).Stringer("remote", session.conn.RemoteAddr()).Msg("Mux connection closed")
+			return
+		}
+
+		select {
+		case s.incoming <- stream:
+		case <-s.closedCh:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
+	select {
+	case <-s.closedCh:
+		return nil, os.ErrClosed
+	case stream := <-s.incoming:
+		return stream, nil
+	}
+}
+
+func (s *ServerSession) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closedCh)
+		err = s.listener.Close()
+	})
+
+	return err
+}
+
+type ClientSession struct {
+	dial    netx.Dialer
+	config  Config
+	mu      sync.Mutex
+	session *Session
+}
+
+func NewClientSession(dial netx.Dialer, config Config) *ClientSession {
+	return &ClientSession{
+		dial:   dial,
+		config: config,
+	}
+}
+
+func (s *ClientSession) bootstrap() (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil && !s.session.IsClosed() {
+		return s.session, nil
+	}
+
+	conn, err := s.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	s.session = NewSession(conn, true, s.config)
+	return s.session, nil
+}
+
+func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	session, err := s.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	return session.OpenStream()
+}
+
+func (s *ClientSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != nil {
+		err := s.session.Close()
+		s.session = nil
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,606 @@
+package muxnet
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every frame starts with a fixed header: frame type, flags, stream ID and a
+// length, all big endian. For data frames the length is the size of the
+// payload following the header, for window updates it is the credit granted
+// to the peer and for pings it is an opaque value echoed back.
+const (
+	frameData byte = iota
+	frameWindowUpdate
+	framePing
+	frameGoAway
+
+	headerSize = 10
+)
+
+const (
+	flagSYN byte = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+const (
+	// initialWindow is the receive window of every stream. A window update is
+	// sent once half of it was consumed.
+	initialWindow = 256 * 1024
+	maxFrameSize  = 64 * 1024
+	acceptBacklog = 256
+)
+
+var (
+	ErrSessionClosed    = errors.New("mux session closed")
+	ErrStreamReset      = errors.New("mux stream reset by peer")
+	ErrKeepAliveTimeout = errors.New("mux keepalive timeout")
+)
+
+type Config struct {
+	// KeepAliveInterval is how often the session pings its peer. Zero
+	// disables keepalives.
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout is how long to wait for a ping to be answered before
+	// the session is considered dead.
+	KeepAliveTimeout time.Duration
+}
+
+var DefaultConfig = Config{
+	KeepAliveInterval: 30 * time.Second,
+	KeepAliveTimeout:  10 * time.Second,
+}
+
+// Session multiplexes streams over a single net.Conn. Each stream has its own
+// flow-control window, so a stream nobody reads from doesn't stall the others.
+type Session struct {
+	conn    net.Conn
+	config  Config
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	pings    map[uint32]chan struct{}
+	nextPing uint32
+	err      error
+
+	acceptCh chan *Stream
+	closedCh chan struct{}
+}
+
+// NewSession starts multiplexing over conn. Client sessions use odd stream IDs
+// and server sessions even ones, so both sides may open streams.
+func NewSession(conn net.Conn, client bool, config Config) *Session {
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		streams:  make(map[uint32]*Stream),
+		nextID:   2,
+		pings:    make(map[uint32]chan struct{}),
+		acceptCh: make(chan *Stream, acceptBacklog),
+		closedCh: make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+
+	return s
+}
+
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+
+	stream := newStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.nextID += 2
+	s.mu.Unlock()
+
+	err := s.writeFrame(frameData, flagSYN, stream.id, 0, nil)
+	if err != nil {
+		s.removeStream(stream.id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closedCh:
+		return nil, s.Err()
+	}
+}
+
+// Ping sends a ping and waits for the peer to answer it.
+func (s *Session) Ping() (time.Duration, error) {
+	done := make(chan struct{})
+
+	s.mu.Lock()
+	id := s.nextPing
+	s.nextPing++
+	s.pings[id] = done
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	err := s.writeFrame(framePing, flagSYN, 0, id, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.NewTimer(cmp.Or(s.config.KeepAliveTimeout, s.config.KeepAliveInterval))
+	defer timeout.Stop()
+
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-timeout.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.closedCh:
+		return 0, s.Err()
+	}
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := s.Ping()
+			if err != nil {
+				s.closeWithError(err)
+				return
+			}
+		case <-s.closedCh:
+			return
+		}
+	}
+}
+
+// Err returns why the session was closed, or nil while it is still open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) IsClosed() bool {
+	return s.Err() != nil
+}
+
+// Close sends a go away to the peer and resets every open stream.
+func (s *Session) Close() error {
+	if s.IsClosed() {
+		return nil
+	}
+
+	err := s.writeFrame(frameGoAway, 0, 0, 0, nil)
+	s.closeWithError(ErrSessionClosed)
+	return err
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+
+	close(s.closedCh)
+	s.conn.Close()
+
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) writeFrame(frameType, flags byte, id, length uint32, payload []byte) error {
+	var header [headerSize]byte
+	header[0] = frameType
+	header[1] = flags
+	binary.BigEndian.PutUint32(header[2:6], id)
+	binary.BigEndian.PutUint32(header[6:10], length)
+
+	buffers := net.Buffers{header[:]}
+	if len(payload) > 0 {
+		buffers = append(buffers, payload)
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	_, err := buffers.WriteTo(s.conn)
+	if err != nil {
+		s.closeWithError(err)
+	}
+
+	return err
+}
+
+// writeControl sends a frame without blocking the caller. The receive loop
+// must never wait on the connection's write side: if both peers were blocked
+// writing to each other, neither would read anymore.
+func (s *Session) writeControl(frameType, flags byte, id, length uint32) {
+	go s.writeFrame(frameType, flags, id, length, nil)
+}
+
+func (s *Session) recvLoop() {
+	err := s.recvFrames()
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrSessionClosed
+	}
+
+	s.closeWithError(err)
+}
+
+func (s *Session) recvFrames() error {
+	var header [headerSize]byte
+	for {
+		_, err := io.ReadFull(s.conn, header[:])
+		if err != nil {
+			return err
+		}
+
+		frameType := header[0]
+		flags := header[1]
+		id := binary.BigEndian.Uint32(header[2:6])
+		length := binary.BigEndian.Uint32(header[6:10])
+
+		switch frameType {
+		case frameData:
+			err = s.handleData(flags, id, length)
+		case frameWindowUpdate:
+			if stream := s.stream(id); stream != nil {
+				stream.addSendWindow(length)
+			}
+		case framePing:
+			err = s.handlePing(flags, length)
+		case frameGoAway:
+			return ErrSessionClosed
+		default:
+			err = fmt.Errorf("unknown frame type %d", frameType)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) handleData(flags byte, id, length uint32) error {
+	if flags&flagSYN != 0 {
+		stream := newStream(s, id)
+
+		s.mu.Lock()
+		existing := s.streams[id]
+		if existing == nil {
+			s.streams[id] = stream
+		}
+		s.mu.Unlock()
+
+		if existing != nil {
+			// The peer reused the ID of a live stream: reset it rather than
+			// mixing the data of both.
+			existing.fail(ErrStreamReset)
+			s.removeStream(id)
+			s.writeControl(frameData, flagRST, id, 0)
+			_, err := io.CopyN(io.Discard, s.conn, int64(length))
+			return err
+		}
+
+		select {
+		case s.acceptCh <- stream:
+		default:
+			s.removeStream(id)
+			s.writeControl(frameData, flagRST, id, 0)
+		}
+	}
+
+	stream := s.stream(id)
+	if stream == nil {
+		// The stream was closed locally; drop whatever is still in flight.
+		_, err := io.CopyN(io.Discard, s.conn, int64(length))
+		return err
+	}
+
+	if length > 0 {
+		err := stream.receive(s.conn, length)
+		if err != nil {
+			return err
+		}
+	}
+
+	if flags&flagFIN != 0 {
+		stream.receiveFIN()
+	}
+	if flags&flagRST != 0 {
+		stream.fail(ErrStreamReset)
+		s.removeStream(id)
+	}
+
+	return nil
+}
+
+func (s *Session) handlePing(flags byte, id uint32) error {
+	if flags&flagSYN != 0 {
+		s.writeControl(framePing, flagACK, 0, id)
+		return nil
+	}
+
+	s.mu.Lock()
+	done, ok := s.pings[id]
+	delete(s.pings, id)
+	s.mu.Unlock()
+
+	if ok {
+		close(done)
+	}
+
+	return nil
+}
+
+// Stream is one multiplexed stream of a Session. It implements netx.Stream.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	recvBuf    bytes.Buffer
+	recvWindow uint32
+	consumed   uint32
+	sendWindow uint32
+	finSent    bool
+	finRecv    bool
+	readClosed bool
+	err        error
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	s := &Stream{
+		session:    session,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) Read(p []byte) (n int, err error) {
+	s.mu.Lock()
+	for s.recvBuf.Len() == 0 && !s.finRecv && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.recvBuf.Len() == 0 {
+		defer s.mu.Unlock()
+		if s.finRecv {
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+
+	n, _ = s.recvBuf.Read(p)
+	credit := s.consume(uint32(n))
+	s.mu.Unlock()
+
+	if credit > 0 {
+		err = s.session.writeFrame(frameWindowUpdate, 0, s.id, credit, nil)
+	}
+
+	return n, err
+}
+
+// consume accounts n read bytes and returns the credit to grant to the peer,
+// if it's time to send a window update.
+func (s *Stream) consume(n uint32) uint32 {
+	s.consumed += n
+	if s.consumed < initialWindow/2 {
+		return 0
+	}
+
+	credit := s.consumed
+	s.consumed = 0
+	s.recvWindow += credit
+	return credit
+}
+
+func (s *Stream) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.finSent && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return n, s.err
+		}
+		if s.finSent {
+			s.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+
+		chunk := min(uint32(len(p)-n), s.sendWindow, maxFrameSize)
+		s.sendWindow -= chunk
+		s.mu.Unlock()
+
+		err = s.session.writeFrame(frameData, 0, s.id, chunk, p[n:n+int(chunk)])
+		if err != nil {
+			return n, err
+		}
+
+		n += int(chunk)
+	}
+
+	return n, nil
+}
+
+// Close finishes writing and, if the peer hasn't finished yet, resets the
+// stream so it stops sending.
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+
+	s.mu.Lock()
+	reset := !s.finRecv && s.err == nil
+	s.readClosed = true
+	s.recvBuf.Reset()
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.session.removeStream(s.id)
+	if reset {
+		err = errors.Join(err, s.session.writeFrame(frameData, flagRST, s.id, 0, nil))
+	}
+
+	return err
+}
+
+// CloseRead discards buffered and further incoming data, still returning
+// window credit so the peer is never blocked on it.
+func (s *Stream) CloseRead() error {
+	s.mu.Lock()
+	s.readClosed = true
+	credit := uint32(s.recvBuf.Len()) + s.consumed
+	s.recvBuf.Reset()
+	s.consumed = 0
+	s.recvWindow += credit
+	s.mu.Unlock()
+
+	if credit > 0 {
+		return s.session.writeFrame(frameWindowUpdate, 0, s.id, credit, nil)
+	}
+
+	return nil
+}
+
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.finSent || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.finSent = true
+	done := s.finRecv
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.session.removeStream(s.id)
+	}
+
+	return s.session.writeFrame(frameData, flagFIN, s.id, 0, nil)
+}
+
+// receive reads length bytes of payload from r into the receive buffer.
+func (s *Stream) receive(r io.Reader, length uint32) error {
+	s.mu.Lock()
+	if length > s.recvWindow {
+		s.mu.Unlock()
+		return fmt.Errorf("stream %d exceeded its receive window: %d > %d", s.id, length, s.recvWindow)
+	}
+
+	if !s.readClosed {
+		s.recvWindow -= length
+		n, err := s.recvBuf.ReadFrom(io.LimitReader(r, int64(length)))
+		if err == nil && n < int64(length) {
+			err = io.ErrUnexpectedEOF
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	_, err := io.CopyN(io.Discard, r, int64(length))
+	if err == nil {
+		s.session.writeControl(frameWindowUpdate, 0, s.id, length)
+	}
+
+	return err
+}
+
+func (s *Stream) receiveFIN() {
+	s.mu.Lock()
+	s.finRecv = true
+	done := s.finSent
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.session.removeStream(s.id)
+	}
+}
+
+func (s *Stream) addSendWindow(credit uint32) {
+	s.mu.Lock()
+	s.sendWindow += credit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
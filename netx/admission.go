@@ -0,0 +1,25 @@
+package netx
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrOverloaded is returned to clients opening a stream the server has no
+// room for.
+var ErrOverloaded = errors.New("overloaded: too many streams")
+
+// Admission decides whether a stream opened from remote may be accepted,
+// waiting while the stream is queued. remote is nil if unknown. release gives
+// the slot back once the stream is done. A nil Admission admits every stream.
+type Admission func(ctx context.Context, remote net.Addr) (release func(), err error)
+
+// Admit is the nil-safe way to call a.
+func (a Admission) Admit(ctx context.Context, remote net.Addr) (release func(), err error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	return a(ctx, remote)
+}
@@ -0,0 +1,33 @@
+package netx
+
+import (
+	"io"
+	"sync"
+)
+
+// CopyBufferSize is the size of the buffers ReadFrom reads into, that of
+// io.Copy.
+const CopyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, CopyBufferSize)
+		return &buf
+	},
+}
+
+// WriterOnly hides the ReadFrom of a writer from io.Copy and io.CopyBuffer.
+type WriterOnly struct {
+	io.Writer
+}
+
+// ReadFrom writes everything read from r to w like io.Copy, but through a
+// pooled buffer rather than one allocated per call. Writers implement
+// io.ReaderFrom with it. Readers implementing io.WriterTo still write to w
+// directly.
+func ReadFrom(w io.Writer, r io.Reader) (n int64, err error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(WriterOnly{w}, r, *buf)
+}
@@ -0,0 +1,40 @@
+package netx
+
+import (
+	"io"
+	"testing"
+)
+
+// BenchmarkReadFrom copies from a reader without WriteTo to a writer without
+// ReadFrom, the case ReadFrom saves io.Copy's buffer in.
+func BenchmarkReadFrom(b *testing.B) {
+	copies := []struct {
+		name string
+		copy func(w io.Writer, r io.Reader) (int64, error)
+	}{
+		{"pooled", ReadFrom},
+		{"io.Copy", io.Copy},
+	}
+
+	const size = 256 * 1024
+	for _, c := range copies {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				n, err := c.copy(discard{}, io.LimitReader(zeros{}, size))
+				if err != nil || n != size {
+					b.Fatalf("copied %d bytes with error %v, want %d", n, err, size)
+				}
+			}
+		})
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -1,6 +1,13 @@
 package netx
 
-import "io"
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
 
 // Stream a bidi stream
 type Stream interface {
@@ -19,3 +26,54 @@ type ClientSession interface {
 	OpenStream() (Stream, error)
 	io.Closer
 }
+
+// Addressed is implemented by streams which know the addresses of the
+// connection they run on.
+type Addressed interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// ContextOpener is implemented by client sessions which can open a stream
+// within a context, e.g. to trace the dial and calls doing it.
+type ContextOpener interface {
+	OpenStreamContext(ctx context.Context) (Stream, error)
+}
+
+// ContextStream is implemented by streams which trace their calls. Accepted
+// streams carry the context they were accepted in, SetContext sets the one
+// later calls are made in.
+type ContextStream interface {
+	Context() context.Context
+	SetContext(ctx context.Context)
+}
+
+// ConnStream is implemented by streams owning a whole connection, so a relay
+// can copy between connections directly, e.g. with splice(2).
+type ConnStream interface {
+	NetConn() net.Conn
+}
+
+// Dialer opens a connection for a client session
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// ErrUnauthenticated is returned to clients which presented a wrong token.
+var ErrUnauthenticated = errors.New("unauthenticated: wrong or missing token")
+
+// CheckToken reports whether a client presented the token a server expects,
+// in constant time. Any token is fine if the server expects none.
+func CheckToken(expected, presented string) bool {
+	return expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(presented)) == 1
+}
+
+// ErrKeepAliveTimeout is why a connection was closed when its peer didn't
+// answer a ping in time.
+var ErrKeepAliveTimeout = errors.New("keepalive timeout")
+
+// KeepAlive is how sessions detect dead peers and keep the NAT mappings of
+// idle connections: they ping every Interval and give up on the connection
+// if a ping isn't answered within Timeout. A zero Interval disables pings.
+type KeepAlive struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
@@ -0,0 +1,161 @@
+package netx
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Pipe is io.Pipe plus PipeReader.WriteTo, which writes the slices passed to
+// PipeWriter.Write straight to its destination instead of copying them into
+// the buffer of a Read first. Writes block until their bytes were read or
+// written on, so a Write may pass a slice it reuses once it returns, e.g. the
+// payload of a received message.
+func Pipe() (*PipeReader, *PipeWriter) {
+	p := &pipe{
+		wrCh: make(chan []byte),
+		rdCh: make(chan int),
+		done: make(chan struct{}),
+	}
+	return &PipeReader{p}, &PipeWriter{p}
+}
+
+type pipe struct {
+	wrMu sync.Mutex
+	wrCh chan []byte
+	rdCh chan int
+
+	once sync.Once
+	done chan struct{}
+	rerr atomic.Pointer[error]
+	werr atomic.Pointer[error]
+}
+
+func (p *pipe) read(b []byte) (n int, err error) {
+	select {
+	case <-p.done:
+		return 0, p.readCloseError()
+	default:
+	}
+
+	select {
+	case bw := <-p.wrCh:
+		nr := copy(b, bw)
+		p.rdCh <- nr
+		return nr, nil
+	case <-p.done:
+		return 0, p.readCloseError()
+	}
+}
+
+func (p *pipe) writeTo(w io.Writer) (n int64, err error) {
+	for {
+		select {
+		case bw := <-p.wrCh:
+			nw, err := w.Write(bw)
+			p.rdCh <- nw
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+		case <-p.done:
+			err := p.readCloseError()
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+	}
+}
+
+func (p *pipe) write(b []byte) (n int, err error) {
+	select {
+	case <-p.done:
+		return 0, p.writeCloseError()
+	default:
+		p.wrMu.Lock()
+		defer p.wrMu.Unlock()
+	}
+
+	for once := true; once || len(b) > 0; once = false {
+		select {
+		case p.wrCh <- b:
+			nw := <-p.rdCh
+			b = b[nw:]
+			n += nw
+		case <-p.done:
+			return n, p.writeCloseError()
+		}
+	}
+	return n, nil
+}
+
+func (p *pipe) closeRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	p.rerr.CompareAndSwap(nil, &err)
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *pipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.werr.CompareAndSwap(nil, &err)
+	p.once.Do(func() { close(p.done) })
+}
+
+// readCloseError is the writer's error unless the reader closed first.
+func (p *pipe) readCloseError() error {
+	if werr := p.werr.Load(); p.rerr.Load() == nil && werr != nil {
+		return *werr
+	}
+	return io.ErrClosedPipe
+}
+
+// writeCloseError is the reader's error unless the writer closed first.
+func (p *pipe) writeCloseError() error {
+	if rerr := p.rerr.Load(); p.werr.Load() == nil && rerr != nil {
+		return *rerr
+	}
+	return io.ErrClosedPipe
+}
+
+// PipeReader is the read half of a Pipe.
+type PipeReader struct{ p *pipe }
+
+func (r *PipeReader) Read(b []byte) (n int, err error) {
+	return r.p.read(b)
+}
+
+// WriteTo writes everything written to the pipe to w until the writer closes,
+// without copying it.
+func (r *PipeReader) WriteTo(w io.Writer) (n int64, err error) {
+	return r.p.writeTo(w)
+}
+
+func (r *PipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+func (r *PipeReader) CloseWithError(err error) error {
+	r.p.closeRead(err)
+	return nil
+}
+
+// PipeWriter is the write half of a Pipe.
+type PipeWriter struct{ p *pipe }
+
+func (w *PipeWriter) Write(b []byte) (n int, err error) {
+	return w.p.write(b)
+}
+
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+func (w *PipeWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
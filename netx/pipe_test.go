@@ -0,0 +1,256 @@
+package netx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+type pipeReader interface {
+	io.ReadCloser
+	CloseWithError(err error) error
+}
+
+type pipeWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// pipes are the implementations checked against each other, io.Pipe being
+// the reference.
+var pipes = []struct {
+	name string
+	new  func() (pipeReader, pipeWriter)
+}{
+	{"io", func() (pipeReader, pipeWriter) { return io.Pipe() }},
+	{"netx", func() (pipeReader, pipeWriter) { return Pipe() }},
+}
+
+var errTest = errors.New("test error")
+
+func TestPipe(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, r pipeReader, w pipeWriter)
+	}{{
+		name: "short reads",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			go func() {
+				w.Write([]byte("hello world"))
+				w.Close()
+			}()
+
+			var got []byte
+			buf := make([]byte, 3)
+			for {
+				n, err := r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if string(got) != "hello world" {
+				t.Fatalf("read %q", got)
+			}
+		},
+	}, {
+		name: "write close with error",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			w.CloseWithError(errTest)
+			if _, err := r.Read(make([]byte, 1)); err != errTest {
+				t.Fatalf("read error %v, want %v", err, errTest)
+			}
+		},
+	}, {
+		name: "write after close",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			w.Close()
+			if _, err := w.Write([]byte("x")); err != io.ErrClosedPipe {
+				t.Fatalf("write error %v, want %v", err, io.ErrClosedPipe)
+			}
+		},
+	}, {
+		name: "read close",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			r.Close()
+			if _, err := w.Write([]byte("x")); err != io.ErrClosedPipe {
+				t.Fatalf("write error %v, want %v", err, io.ErrClosedPipe)
+			}
+			if _, err := r.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+				t.Fatalf("read error %v, want %v", err, io.ErrClosedPipe)
+			}
+		},
+	}, {
+		name: "read close with error",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			r.CloseWithError(errTest)
+			if _, err := w.Write([]byte("x")); err != errTest {
+				t.Fatalf("write error %v, want %v", err, errTest)
+			}
+		},
+	}, {
+		name: "first close wins",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			w.CloseWithError(errTest)
+			w.CloseWithError(io.ErrUnexpectedEOF)
+			if _, err := r.Read(make([]byte, 1)); err != errTest {
+				t.Fatalf("read error %v, want %v", err, errTest)
+			}
+		},
+	}, {
+		name: "partial write",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				n, err := w.Write([]byte("hello world"))
+				if n != 5 || err != errTest {
+					t.Errorf("wrote %d with error %v, want 5 with %v", n, err, errTest)
+				}
+			}()
+
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r.CloseWithError(errTest)
+			<-done
+		},
+	}, {
+		name: "concurrent writes",
+		run: func(t *testing.T, r pipeReader, w pipeWriter) {
+			const writers, chunk = 8, 1000
+
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w.Write(bytes.Repeat([]byte{byte('a' + i)}, chunk))
+				}()
+			}
+			go func() {
+				wg.Wait()
+				w.Close()
+			}()
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != writers*chunk {
+				t.Fatalf("read %d bytes, want %d", len(got), writers*chunk)
+			}
+			// Writes are never interleaved.
+			for i := 0; i < len(got); i += chunk {
+				if !bytes.Equal(got[i:i+chunk], bytes.Repeat(got[i:i+1], chunk)) {
+					t.Fatalf("write at %d interleaved", i)
+				}
+			}
+		},
+	}}
+
+	for _, p := range pipes {
+		for _, test := range tests {
+			t.Run(p.name+"/"+test.name, func(t *testing.T) {
+				r, w := p.new()
+				test.run(t, r, w)
+			})
+		}
+	}
+}
+
+func TestPipeWriteTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		close   error
+		dst     io.Writer
+		want    string
+		wantErr error
+	}{{
+		name: "until eof",
+		dst:  new(bytes.Buffer),
+		want: "hello world",
+	}, {
+		name:    "writer error",
+		close:   errTest,
+		dst:     new(bytes.Buffer),
+		want:    "hello world",
+		wantErr: errTest,
+	}, {
+		name:    "destination error",
+		dst:     failingWriter{},
+		wantErr: errTest,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, w := Pipe()
+			go func() {
+				w.Write([]byte("hello "))
+				w.Write([]byte("world"))
+				w.CloseWithError(test.close)
+			}()
+
+			n, err := r.WriteTo(test.dst)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if n != int64(len(test.want)) {
+				t.Fatalf("wrote %d bytes, want %d", n, len(test.want))
+			}
+			if buf, ok := test.dst.(*bytes.Buffer); ok && buf.String() != test.want {
+				t.Fatalf("wrote %q, want %q", buf, test.want)
+			}
+			// A failed WriteTo leaves the writer blocked until the pipe is
+			// closed.
+			r.Close()
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errTest
+}
+
+// BenchmarkPipe copies through each pipe to a writer without ReadFrom, which
+// io.Copy only writes to directly through the WriteTo of netx.Pipe.
+func BenchmarkPipe(b *testing.B) {
+	for _, p := range pipes {
+		b.Run(p.name, func(b *testing.B) {
+			chunk := make([]byte, CopyBufferSize)
+			b.SetBytes(int64(len(chunk)))
+			b.ReportAllocs()
+
+			r, w := p.new()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					w.Write(chunk)
+				}
+				w.Close()
+			}()
+
+			n, err := io.Copy(discard{}, r)
+			if err != nil {
+				b.Fatalf("copy error: %v", err)
+			}
+			if n != int64(b.N*len(chunk)) {
+				b.Fatalf("copied %d bytes, want %d", n, b.N*len(chunk))
+			}
+		})
+	}
+}
+
+// discard is io.Discard without its ReadFrom.
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package netx
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrStreamQuota = errors.New("stream quota exceeded")
+	ErrByteQuota   = errors.New("byte quota exceeded")
+)
+
+// Scope limits what a proxy capability may be used for, zero is unlimited.
+type Scope struct {
+	// MaxStreams is how many streams may be open at the same time.
+	MaxStreams uint32
+	// MaxBytes is how many bytes may be relayed in both directions.
+	MaxBytes uint64
+}
+
+// Restrict returns the scope within both s and to.
+func (s Scope) Restrict(to Scope) Scope {
+	return Scope{
+		MaxStreams: minLimit(s.MaxStreams, to.MaxStreams),
+		MaxBytes:   minLimit(s.MaxBytes, to.MaxBytes),
+	}
+}
+
+func (s Scope) String() string {
+	return fmt.Sprintf("streams=%d,bytes=%d", s.MaxStreams, s.MaxBytes)
+}
+
+func minLimit[T uint32 | uint64](a, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Quota tracks the usage of a scope. Usage counts against the quota it was
+// restricted from as well, so a restricted capability can't get around the
+// limits of the one it was derived from. A nil Quota is unlimited.
+type Quota struct {
+	scope  Scope
+	parent *Quota
+
+	mu      sync.Mutex
+	streams uint32
+	bytes   uint64
+}
+
+func NewQuota(scope Scope, parent *Quota) *Quota {
+	if parent != nil {
+		scope = parent.scope.Restrict(scope)
+	}
+
+	return &Quota{
+		scope:  scope,
+		parent: parent,
+	}
+}
+
+func (q *Quota) Scope() Scope {
+	if q == nil {
+		return Scope{}
+	}
+
+	return q.scope
+}
+
+// OpenStream takes a stream of the quota, which CloseStream gives back.
+func (q *Quota) OpenStream() error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.scope.MaxStreams != 0 && q.streams >= q.scope.MaxStreams {
+		q.mu.Unlock()
+		return ErrStreamQuota
+	}
+	q.streams++
+	q.mu.Unlock()
+
+	err := q.parent.OpenStream()
+	if err != nil {
+		q.mu.Lock()
+		q.streams--
+		q.mu.Unlock()
+	}
+
+	return err
+}
+
+func (q *Quota) CloseStream() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.streams--
+	q.mu.Unlock()
+	q.parent.CloseStream()
+}
+
+// Use counts n bytes relayed, failing once the quota is used up.
+func (q *Quota) Use(n int) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	q.bytes += uint64(n)
+	exceeded := q.scope.MaxBytes != 0 && q.bytes > q.scope.MaxBytes
+	q.mu.Unlock()
+
+	if exceeded {
+		return ErrByteQuota
+	}
+
+	return q.parent.Use(n)
+}
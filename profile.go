@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Profiles which can be captured during a bench run, all of them by default.
+var benchProfiles = []string{"cpu", "heap", "mutex", "block", "trace"}
+
+const (
+	// mutexProfileFraction samples one in this many mutex contention events.
+	mutexProfileFraction = 10
+	// blockProfileRate samples one blocking event per this many nanoseconds
+	// spent blocked.
+	blockProfileRate = 10000
+)
+
+func parseProfiles(s string) ([]string, error) {
+	var profiles []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(benchProfiles, name) {
+			return nil, fmt.Errorf("unknown profile %q, available: %s", name, strings.Join(benchProfiles, ", "))
+		}
+
+		profiles = append(profiles, name)
+	}
+
+	return profiles, nil
+}
+
+// benchResultsDir names the results directory of a bench run after the
+// transports, the bench parameters and the time, e.g.
+// tcp+mem_capnp+mem_8x64M_32K_20261018-150405.
+func benchResultsDir(root string, args Args, benchArgs BenchArgs) string {
+	listen, _, _ := strings.Cut(args.Listen, "://")
+	connect, _, _ := strings.Cut(args.Connect, "://")
+	name := fmt.Sprintf("%s_%s_%dx%s_%s_%s", listen, connect, benchArgs.Streams,
+		formatByteSize(benchArgs.Size), formatByteSize(benchArgs.ChunkSize), time.Now().Format("20060102-150405"))
+
+	return filepath.Join(root, name)
+}
+
+// formatByteSize is the inverse of parseByteSize.
+func formatByteSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+
+	return fmt.Sprint(n)
+}
+
+// profiler captures profiles into a directory between start and stop.
+type profiler struct {
+	dir      string
+	profiles []string
+	cpu      *os.File
+	trace    *os.File
+}
+
+func startProfiler(dir string, profiles []string) (*profiler, error) {
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &profiler{
+		dir:      dir,
+		profiles: profiles,
+	}
+
+	for _, name := range profiles {
+		switch name {
+		case "cpu":
+			p.cpu, err = p.create("cpu.pprof")
+			if err == nil {
+				err = pprof.StartCPUProfile(p.cpu)
+			}
+		case "trace":
+			p.trace, err = p.create("trace.out")
+			if err == nil {
+				err = trace.Start(p.trace)
+			}
+		case "mutex":
+			runtime.SetMutexProfileFraction(mutexProfileFraction)
+		case "block":
+			runtime.SetBlockProfileRate(blockProfileRate)
+		}
+
+		if err != nil {
+			return nil, errors.Join(err, p.stop())
+		}
+	}
+
+	return p, nil
+}
+
+func (p *profiler) create(name string) (*os.File, error) {
+	return os.Create(filepath.Join(p.dir, name))
+}
+
+// stop ends the running profiles and writes out the sampled ones.
+func (p *profiler) stop() error {
+	var errs []error
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		errs = append(errs, p.cpu.Close())
+	}
+	if p.trace != nil {
+		trace.Stop()
+		errs = append(errs, p.trace.Close())
+	}
+
+	for _, name := range p.profiles {
+		switch name {
+		case "heap":
+			// Up to date statistics of the bench's allocations.
+			runtime.GC()
+			errs = append(errs, p.write(name))
+		case "mutex":
+			errs = append(errs, p.write(name))
+			runtime.SetMutexProfileFraction(0)
+		case "block":
+			errs = append(errs, p.write(name))
+			runtime.SetBlockProfileRate(0)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *profiler) write(name string) error {
+	file, err := p.create(name + ".pprof")
+	if err != nil {
+		return err
+	}
+
+	err = pprof.Lookup(name).WriteTo(file, 0)
+	return errors.Join(err, file.Close())
+}
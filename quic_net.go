@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"proxy-bench/netx"
+	"proxy-bench/quicnet"
+)
+
+var (
+	errQuicOverMem   = errors.New("quic runs over UDP and can't use the mem modifier")
+	errQuicConnShape = errors.New("quic has no connection to shape, use the shape modifier with layer=stream")
+)
+
+// QUIC always runs over TLS 1.3, so the tls modifier is implied.
+func init() {
+	serverSessionCreators["quic"] = func(args Args) (netx.ServerSession, error) {
+		if isMemAddress(args.Listen) {
+			return nil, errQuicOverMem
+		}
+		if args.ListenShape != nil {
+			return nil, errQuicConnShape
+		}
+
+		_, _, address := splitAddress(args.Listen)
+		tlsConfig, err := getServerTLSConfig(args)
+		if err != nil {
+			return nil, err
+		}
+
+		return quicnet.NewServerSession(address, tlsConfig, args.KeepAlive)
+	}
+
+	clientSessionCreators["quic"] = func(args Args) (netx.ClientSession, error) {
+		if isMemAddress(args.Connect) {
+			return nil, errQuicOverMem
+		}
+		if args.ConnectShape != nil {
+			return nil, errQuicConnShape
+		}
+
+		_, _, address := splitAddress(args.Connect)
+		tlsConfig, err := getClientTLSConfig(args)
+		if err != nil {
+			return nil, err
+		}
+
+		return quicnet.NewClientSession(address, tlsConfig, args.KeepAlive), nil
+	}
+}
@@ -0,0 +1,242 @@
+package quicnet
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"proxy-bench/logx"
+	"proxy-bench/metrics"
+	"proxy-bench/netx"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+var logger = logx.New("quicnet")
+
+const alpn = "proxy-bench"
+
+// streamOpen is written by the opener as the first byte of every stream, since
+// QUIC only announces a stream to the peer once data is sent on it.
+const streamOpen byte = 0
+
+// streamCanceled is the application error code sent when a stream side is
+// closed before it was finished.
+const streamCanceled quic.StreamErrorCode = 0
+
+var quicConfig = &quic.Config{
+	MaxIncomingStreams: 1024,
+}
+
+// newQuicConfig is quicConfig with keepAlive, QUIC closes connections which
+// received nothing, not even the answer to a ping, for MaxIdleTimeout.
+func newQuicConfig(keepAlive netx.KeepAlive) *quic.Config {
+	config := quicConfig.Clone()
+	if keepAlive.Interval > 0 {
+		config.KeepAlivePeriod = keepAlive.Interval
+		config.MaxIdleTimeout = keepAlive.Interval + cmp.Or(keepAlive.Timeout, keepAlive.Interval)
+	}
+
+	return config
+}
+
+type ServerSession struct {
+	listener *quic.Listener
+	incoming chan netx.Stream
+	closedCh chan struct{}
+	once     sync.Once
+}
+
+// NewServerSession listens on the UDP address right away.
+func NewServerSession(address string, tlsConfig *tls.Config, keepAlive netx.KeepAlive) (*ServerSession, error) {
+	listener, err := quic.ListenAddr(address, quicTLSConfig(tlsConfig), newQuicConfig(keepAlive))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Str("address", address).Msg("Success to listen")
+
+	s := &ServerSession{
+		listener: listener,
+		incoming: make(chan netx.Stream),
+		closedCh: make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				logger.Warn().Err(err).Msg("QUIC listener stopped")
+				return
+			}
+
+			logger.Debug().Stringer("remote", conn.RemoteAddr()).Msg("Accepted QUIC connection")
+			go s.acceptStreams(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *ServerSession) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			logger.Debug().Err(err).Stringer("remote", conn.RemoteAddr()).Msg("QUIC connection closed")
+			return
+		}
+
+		go func() {
+			var open [1]byte
+			_, err := io.ReadFull(stream, open[:])
+			if err != nil {
+				logger.Warn().Err(err).Stringer("remote", conn.RemoteAddr()).Msg("Failed to read stream open")
+				stream.CancelRead(streamCanceled)
+				stream.CancelWrite(streamCanceled)
+				return
+			}
+
+			select {
+			case s.incoming <- newQuicStream(stream, conn):
+			case <-s.closedCh:
+				stream.CancelRead(streamCanceled)
+				stream.CancelWrite(streamCanceled)
+			}
+		}()
+	}
+}
+
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
+	select {
+	case <-s.closedCh:
+		return nil, os.ErrClosed
+	case stream := <-s.incoming:
+		return stream, nil
+	}
+}
+
+func (s *ServerSession) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closedCh)
+		err = s.listener.Close()
+	})
+
+	return err
+}
+
+type ClientSession struct {
+	address   string
+	tlsConfig *tls.Config
+	config    *quic.Config
+	mu        sync.Mutex
+	conn      *quic.Conn
+}
+
+func NewClientSession(address string, tlsConfig *tls.Config, keepAlive netx.KeepAlive) *ClientSession {
+	return &ClientSession{
+		address:   address,
+		tlsConfig: tlsConfig,
+		config:    newQuicConfig(keepAlive),
+	}
+}
+
+func (s *ClientSession) bootstrap() (*quic.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.Context().Err() == nil {
+		return s.conn, nil
+	}
+	if s.conn != nil {
+		metrics.Reconnects.WithLabelValues("quic").Inc()
+	}
+
+	conn, err := quic.DialAddr(context.Background(), s.address, quicTLSConfig(s.tlsConfig), s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn = conn
+	return conn, nil
+}
+
+func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	conn, err := s.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = stream.Write([]byte{streamOpen})
+	if err != nil {
+		stream.CancelRead(streamCanceled)
+		stream.CancelWrite(streamCanceled)
+		return nil, err
+	}
+
+	return newQuicStream(stream, conn), nil
+}
+
+func (s *ClientSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		err := s.conn.CloseWithError(0, "")
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func newQuicStream(stream *quic.Stream, conn *quic.Conn) *quicStream {
+	return &quicStream{
+		Stream: stream,
+		conn:   conn,
+	}
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *quicStream) Close() error {
+	return errors.Join(s.CloseWrite(), s.CloseRead())
+}
+
+// CloseRead tells the peer to stop sending. It is a no-op once EOF was read.
+func (s *quicStream) CloseRead() error {
+	s.Stream.CancelRead(streamCanceled)
+	return nil
+}
+
+// CloseWrite sends FIN.
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// quicTLSConfig returns a copy of tlsConfig fit for QUIC, which requires TLS
+// 1.3 and its own ALPN protocol instead of h2.
+func quicTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{alpn}
+	return tlsConfig
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"proxy-bench/metrics"
+	"proxy-bench/netx"
+	"proxy-bench/ratelimit"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minBurst is the least a bucket holds, at least one write of io.Copy.
+const minBurst = 64 * 1024
+
+// rateLimits caps the bandwidth of relayed streams per stream, per client
+// session and globally, each direction on its own. Streams of one client
+// session are those with the same downstream remote address, so for
+// transports with a connection per stream, like tcp, a session is a stream.
+type rateLimits struct {
+	streamRate  int64
+	sessionRate int64
+	burst       time.Duration
+	global      directionLimiters
+
+	mu       sync.Mutex
+	sessions map[string]*sessionLimiters
+}
+
+// directionLimiters are indexed by direction, upstream first.
+type directionLimiters [2]*ratelimit.Limiter
+
+type sessionLimiters struct {
+	limiters directionLimiters
+	streams  int
+}
+
+var directions = [2]string{"upstream", "downstream"}
+
+// rateLimiter is nil unless a rate limit is set.
+var rateLimiter *rateLimits
+
+// unaddressedSchemes are the schemes whose accepted streams don't know the
+// remote address they came from, so their sessions can't be told apart for
+// -rate-session. Set by the creators.
+var unaddressedSchemes = make(map[string]bool)
+
+// newRateLimits takes rates in bytes per second, zero is unlimited. burst is
+// how long a bucket may send at full speed after being idle.
+func newRateLimits(streamRate, sessionRate, globalRate int64, burst time.Duration) *rateLimits {
+	if streamRate == 0 && sessionRate == 0 && globalRate == 0 {
+		return nil
+	}
+
+	r := &rateLimits{
+		streamRate:  streamRate,
+		sessionRate: sessionRate,
+		burst:       burst,
+		sessions:    make(map[string]*sessionLimiters),
+	}
+	if globalRate > 0 {
+		r.global = r.newLimiters(globalRate)
+	}
+
+	return r
+}
+
+func (r *rateLimits) newLimiters(rate int64) directionLimiters {
+	burst := max(int64(float64(rate)*r.burst.Seconds()), minBurst)
+	return directionLimiters{ratelimit.New(rate, burst), ratelimit.New(rate, burst)}
+}
+
+// limitStreams wraps the streams of one relay so writes to them wait for
+// the rate limits. Closing the wrapped streams ends waiting writes. release
+// must be called once the relay is done.
+func (r *rateLimits) limitStreams(up, down netx.Stream, session string) (limitedUp, limitedDown netx.Stream, release func()) {
+	if r == nil {
+		return up, down, func() {}
+	}
+
+	var names []string
+	var limiters []directionLimiters
+	if r.streamRate > 0 {
+		names = append(names, "stream")
+		limiters = append(limiters, r.newLimiters(r.streamRate))
+	}
+	release = func() {}
+	if r.sessionRate > 0 && session != "" {
+		names = append(names, "session")
+		limiters = append(limiters, r.openSession(session))
+		release = func() {
+			r.closeSession(session)
+		}
+	}
+	if r.global[0] != nil {
+		names = append(names, "global")
+		limiters = append(limiters, r.global)
+	}
+
+	if len(limiters) == 0 {
+		return up, down, release
+	}
+
+	streams := [2]netx.Stream{up, down}
+	for i := range streams {
+		limited := &rateLimitedStream{
+			Stream: streams[i],
+			closed: make(chan struct{}),
+		}
+		for _, l := range limiters {
+			limited.limiters = append(limited.limiters, l[i])
+		}
+		for _, name := range names {
+			limited.throttled = append(limited.throttled, metrics.ThrottledSeconds.WithLabelValues(directions[i], name))
+		}
+		streams[i] = limited
+	}
+
+	return streams[0], streams[1], release
+}
+
+func (r *rateLimits) openSession(session string) directionLimiters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[session]
+	if !ok {
+		s = &sessionLimiters{limiters: r.newLimiters(r.sessionRate)}
+		r.sessions[session] = s
+	}
+	s.streams++
+
+	return s.limiters
+}
+
+func (r *rateLimits) closeSession(session string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.sessions[session]
+	s.streams--
+	if s.streams == 0 {
+		delete(r.sessions, session)
+	}
+}
+
+// rateLimitedStream waits for its limiters before writing and counts the
+// time waited against the slowest one. Closing it ends waiting writes, which
+// may be long for large writes at low rates.
+type rateLimitedStream struct {
+	netx.Stream
+	limiters  []*ratelimit.Limiter
+	throttled []prometheus.Counter
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *rateLimitedStream) Write(p []byte) (n int, err error) {
+	slowest, wait, ok := ratelimit.Wait(s.closed, len(p), s.limiters...)
+	if slowest >= 0 {
+		s.throttled[slowest].Add(wait.Seconds())
+	}
+	if !ok {
+		return 0, net.ErrClosed
+	}
+
+	return s.Stream.Write(p)
+}
+
+func (s *rateLimitedStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return s.Stream.Close()
+}
+
+// parseRateLimits parses byte sizes per second, empty is unlimited.
+func parseRateLimits(stream, session, global string, burst time.Duration) (*rateLimits, error) {
+	var rates [3]int64
+	for i, s := range []string{stream, session, global} {
+		if s == "" {
+			continue
+		}
+
+		rate, err := parseByteSize(s)
+		if err != nil {
+			return nil, err
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("rate %q is not positive", s)
+		}
+		rates[i] = rate
+	}
+
+	return newRateLimits(rates[0], rates[1], rates[2], burst), nil
+}
@@ -0,0 +1,78 @@
+// Package ratelimit limits bandwidth with token buckets.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes. Reservations may take more than are in
+// the bucket, later ones then wait until the debt is paid off, so writes of
+// any size keep the average rate. A nil Limiter is unlimited.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter of rate bytes per second which lets up to burst
+// bytes through at once after being idle.
+func New(rate, burst int64) *Limiter {
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Reserve takes n bytes from the bucket and returns how long to wait before
+// sending them.
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait reserves n bytes of every limiter and sleeps as long as the slowest
+// one needs, unless done is closed first. It returns the index of that one
+// and the time to wait, -1 if it didn't have to, and false if done ended the
+// wait.
+func Wait(done <-chan struct{}, n int, limiters ...*Limiter) (slowest int, wait time.Duration, ok bool) {
+	slowest = -1
+	for i, l := range limiters {
+		if d := l.Reserve(n); d > wait {
+			slowest, wait = i, d
+		}
+	}
+
+	if wait <= 0 {
+		return slowest, wait, true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return slowest, wait, true
+	case <-done:
+		return slowest, wait, false
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// tolerance covers the time passing between reservations, which refills the
+// bucket a little.
+const tolerance = 10 * time.Millisecond
+
+func TestReserve(t *testing.T) {
+	type reservation struct {
+		idle time.Duration
+		n    int
+		want time.Duration
+	}
+
+	tests := []struct {
+		name         string
+		rate, burst  int64
+		reservations []reservation
+	}{{
+		name:  "within burst",
+		rate:  1000,
+		burst: 500,
+		reservations: []reservation{
+			{n: 200},
+			{n: 300},
+		},
+	}, {
+		name:  "debt",
+		rate:  1000,
+		burst: 500,
+		reservations: []reservation{
+			{n: 600, want: 100 * time.Millisecond},
+			{n: 100, want: 200 * time.Millisecond},
+		},
+	}, {
+		name:  "debt paid off",
+		rate:  1000,
+		burst: 500,
+		reservations: []reservation{
+			{n: 600, want: 100 * time.Millisecond},
+			{idle: 150 * time.Millisecond, n: 100, want: 50 * time.Millisecond},
+		},
+	}, {
+		name:  "burst cap",
+		rate:  10000,
+		burst: 100,
+		reservations: []reservation{
+			{idle: 100 * time.Millisecond, n: 100},
+			{n: 100, want: 10 * time.Millisecond},
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := New(test.rate, test.burst)
+			for i, r := range test.reservations {
+				time.Sleep(r.idle)
+				got := l.Reserve(r.n)
+				if got > r.want || got < r.want-tolerance {
+					t.Fatalf("reservation %d waits %s, want %s", i, got, r.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReserveNil(t *testing.T) {
+	var l *Limiter
+	if got := l.Reserve(1 << 30); got != 0 {
+		t.Fatalf("nil limiter waits %s", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	fast := New(1000, 1000)
+	slow := New(1000, 0)
+
+	start := time.Now()
+	slowest, wait, ok := Wait(nil, 20, fast, nil, slow)
+	if !ok || slowest != 2 {
+		t.Fatalf("slowest %d ok %v, want 2 true", slowest, ok)
+	}
+	if elapsed := time.Since(start); elapsed < wait || wait < 20*time.Millisecond-tolerance {
+		t.Fatalf("waited %s for %s, want 20ms", elapsed, wait)
+	}
+
+	slowest, wait, ok = Wait(nil, 20, fast)
+	if !ok || slowest != -1 || wait != 0 {
+		t.Fatalf("slowest %d wait %s ok %v, want -1 0 true", slowest, wait, ok)
+	}
+}
+
+func TestWaitDone(t *testing.T) {
+	done := make(chan struct{})
+	close(done)
+
+	start := time.Now()
+	_, wait, ok := Wait(done, 1000, New(1000, 0))
+	if ok {
+		t.Fatalf("wait of %s wasn't ended", wait)
+	}
+	if elapsed := time.Since(start); elapsed > tolerance {
+		t.Fatalf("waited %s after done", elapsed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"proxy-bench/shapenet"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const shapeModifier = "shape"
+
+// shapePrefix may start every shape parameter. With the mem modifier it's
+// needed for those which are mem link parameters too, see memLinkParams.
+const shapePrefix = "shape-"
+
+// memLinkParams are the parameters of both shape and mem addresses, left to
+// the mem link unless prefixed with shapePrefix.
+var memLinkParams = map[string]bool{"jitter": true, "bandwidth": true, "buffer": true}
+
+// parseShapeAddress takes the fault injection parameters of the shape
+// modifier out of the address query, e.g.
+// capnp+tls+shape://127.0.0.1:2443?delay=20ms&jitter=5ms&bandwidth=10M&reset=0.0001
+// and returns the address with the remaining query. layer=stream shapes every
+// stream on its own instead of the connections beneath the transport. With
+// the mem modifier jitter, bandwidth and buffer are the mem link's, e.g.
+// capnp+shape+mem://relay?delay=20ms&shape-bandwidth=10M&bandwidth=100M.
+func parseShapeAddress(address string) (rest string, config *shapenet.Config, streamLayer bool, err error) {
+	if !hasModifier(address, shapeModifier) {
+		return address, nil, false, nil
+	}
+
+	rest, rawQuery, _ := strings.Cut(address, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	config = &shapenet.Config{
+		StallTime: time.Second,
+	}
+	mem := isMemAddress(address)
+	for param, values := range query {
+		key, prefixed := strings.CutPrefix(param, shapePrefix)
+		if mem && !prefixed && memLinkParams[key] {
+			continue
+		}
+
+		value := values[len(values)-1]
+		switch key {
+		case "delay":
+			config.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(value)
+		case "bandwidth":
+			config.Bandwidth, err = parseByteSize(value)
+		case "buffer":
+			var size int64
+			size, err = parseByteSize(value)
+			config.BufferSize = int(size)
+		case "reset":
+			config.Reset, err = strconv.ParseFloat(value, 64)
+		case "stall":
+			config.Stall, err = strconv.ParseFloat(value, 64)
+		case "stall-time":
+			config.StallTime, err = time.ParseDuration(value)
+		case "partial":
+			config.Partial, err = strconv.ParseFloat(value, 64)
+		case "seed":
+			config.Seed, err = strconv.ParseUint(value, 10, 64)
+		case "layer":
+			switch value {
+			case "conn":
+			case "stream":
+				streamLayer = true
+			default:
+				err = fmt.Errorf("unknown layer %s, want conn or stream", value)
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return "", nil, false, fmt.Errorf("invalid shape parameter %s in '%s': %w", param, address, err)
+		}
+		query.Del(param)
+	}
+
+	if len(query) > 0 {
+		rest += "?" + query.Encode()
+	}
+
+	return rest, config, streamLayer, nil
+}
@@ -0,0 +1,375 @@
+package shapenet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"proxy-bench/memnet"
+	"proxy-bench/netx"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes the faults injected into a wrapped connection or stream.
+// Delay, Jitter and Bandwidth apply to each direction, the probabilities are
+// rolled for every chunk of bytes passing through.
+type Config struct {
+	Delay     time.Duration
+	Jitter    time.Duration
+	Bandwidth int64
+	// BufferSize is how many bytes per direction may be queued in the
+	// shaper, zero means the memnet default.
+	BufferSize int
+	// Reset is the probability that a chunk aborts the connection instead
+	// of going through.
+	Reset float64
+	// Stall is the probability that a chunk is held back for StallTime
+	// before going through, along with everything queued behind it.
+	Stall     float64
+	StallTime time.Duration
+	// Partial is the probability that a chunk is written to the wrapped
+	// connection in several smaller writes.
+	Partial float64
+	// Seed makes the faults reproducible when not zero, each wrapped
+	// connection draws from its own sequence derived from it.
+	Seed uint64
+}
+
+var wrapped atomic.Uint64
+
+func (c Config) newRand() *rand.Rand {
+	if c.Seed == 0 {
+		return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+
+	return rand.New(rand.NewPCG(c.Seed, wrapped.Add(1)))
+}
+
+// halfCloser is what the shaper needs from the wrapped side.
+type halfCloser interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+// shaper moves bytes between the wrapped side and a memnet pipe, whose links
+// take care of delay, jitter, bandwidth and deadlines. Resets, stalls and
+// partial writes are injected while pumping.
+type shaper struct {
+	config    Config
+	inner     halfCloser
+	reset     func() error
+	outer     *memnet.Conn
+	mu        sync.Mutex
+	rand      *rand.Rand
+	readDone  bool
+	writeDone bool
+	closed    bool
+}
+
+func newShaper(inner halfCloser, reset func() error, config Config) *shapedStream {
+	local, outer := memnet.Pipe(memnet.LinkConfig{
+		Latency:    config.Delay,
+		Jitter:     config.Jitter,
+		Bandwidth:  config.Bandwidth,
+		BufferSize: config.BufferSize,
+	})
+
+	s := &shaper{
+		config: config,
+		inner:  inner,
+		reset:  reset,
+		outer:  outer,
+		rand:   config.newRand(),
+	}
+
+	go s.pumpIn()
+	go s.pumpOut()
+
+	return &shapedStream{
+		Conn:   local,
+		shaper: s,
+	}
+}
+
+func (s *shaper) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < probability
+}
+
+func (s *shaper) split(size int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return 1 + s.rand.IntN(size)
+}
+
+// fault injects the faults rolled for one chunk, it returns false if the
+// connection was reset.
+func (s *shaper) fault() bool {
+	if s.roll(s.config.Reset) {
+		s.abort()
+		return false
+	}
+	if s.roll(s.config.Stall) {
+		time.Sleep(s.config.StallTime)
+	}
+
+	return true
+}
+
+// pumpIn copies from the wrapped side to the shaped one.
+func (s *shaper) pumpIn() {
+	defer s.done(true, false)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.inner.Read(buf)
+		if n > 0 {
+			if !s.fault() {
+				return
+			}
+
+			_, werr := s.outer.Write(buf[:n])
+			if werr != nil {
+				// The shaped side stopped reading.
+				return
+			}
+		}
+
+		if err == io.EOF {
+			s.outer.CloseWrite()
+			return
+		}
+		if err != nil {
+			s.abort()
+			return
+		}
+	}
+}
+
+// pumpOut copies from the shaped side to the wrapped one, splitting writes
+// up if asked to.
+func (s *shaper) pumpOut() {
+	defer s.done(false, true)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.outer.Read(buf)
+		if n > 0 {
+			if !s.fault() {
+				return
+			}
+
+			for data := buf[:n]; len(data) > 0; {
+				size := len(data)
+				if s.roll(s.config.Partial) {
+					size = s.split(size)
+				}
+
+				_, werr := s.inner.Write(data[:size])
+				if werr != nil {
+					s.abort()
+					return
+				}
+				data = data[size:]
+			}
+		}
+
+		if err == io.EOF {
+			s.inner.CloseWrite()
+			return
+		}
+		if err != nil {
+			s.abort()
+			return
+		}
+	}
+}
+
+// done closes the wrapped side once both directions are finished.
+func (s *shaper) done(read, write bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.readDone = s.readDone || read
+	s.writeDone = s.writeDone || write
+	if s.readDone && s.writeDone && !s.closed {
+		s.closed = true
+		s.inner.Close()
+	}
+}
+
+func (s *shaper) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	s.reset()
+	s.outer.Reset()
+}
+
+// shapedStream is the shaped side, a netx.Stream with deadlines.
+type shapedStream struct {
+	*memnet.Conn
+	shaper *shaper
+}
+
+// LocalAddr is the one of the wrapped side, or nil if it has none.
+func (c *shapedStream) LocalAddr() net.Addr {
+	if addressed, ok := c.shaper.inner.(netx.Addressed); ok {
+		return addressed.LocalAddr()
+	}
+
+	return nil
+}
+
+// RemoteAddr is the one of the wrapped side, or nil if it has none.
+func (c *shapedStream) RemoteAddr() net.Addr {
+	if addressed, ok := c.shaper.inner.(netx.Addressed); ok {
+		return addressed.RemoteAddr()
+	}
+
+	return nil
+}
+
+func (c *shapedStream) Close() error {
+	return errors.Join(c.CloseWrite(), c.CloseRead())
+}
+
+func (c *shapedStream) CloseRead() error {
+	c.Conn.CloseRead()
+	c.shaper.done(true, false)
+	return nil
+}
+
+// Conn is a shaped net.Conn. Deadlines apply to the shaped side, the wrapped
+// connection has none.
+type Conn struct {
+	*shapedStream
+}
+
+func WrapConn(conn net.Conn, config Config) *Conn {
+	reset := conn.Close
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		reset = func() error {
+			tcpConn.SetLinger(0)
+			return tcpConn.Close()
+		}
+	}
+
+	return &Conn{
+		shapedStream: newShaper(&connHalfCloser{conn}, reset, config),
+	}
+}
+
+type connHalfCloser struct {
+	net.Conn
+}
+
+func (c *connHalfCloser) CloseWrite() error {
+	if c, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return c.CloseWrite()
+	}
+
+	return nil
+}
+
+type listener struct {
+	net.Listener
+	config Config
+}
+
+// WrapListener shapes every accepted connection.
+func WrapListener(l net.Listener, config Config) net.Listener {
+	return &listener{
+		Listener: l,
+		config:   config,
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapConn(conn, l.config), nil
+}
+
+// WrapStream shapes a single stream. A reset closes the stream abruptly,
+// since streams have no RST of their own.
+func WrapStream(stream netx.Stream, config Config) netx.Stream {
+	reset := func() error {
+		return errors.Join(stream.CloseRead(), stream.Close())
+	}
+
+	return newShaper(stream, reset, config)
+}
+
+type ServerSession struct {
+	netx.ServerSession
+	config Config
+}
+
+// WrapServerSession shapes every accepted stream.
+func WrapServerSession(session netx.ServerSession, config Config) *ServerSession {
+	return &ServerSession{
+		ServerSession: session,
+		config:        config,
+	}
+}
+
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
+	stream, err := s.ServerSession.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapStream(stream, s.config), nil
+}
+
+type ClientSession struct {
+	netx.ClientSession
+	config Config
+}
+
+// WrapClientSession shapes every opened stream.
+func WrapClientSession(session netx.ClientSession, config Config) *ClientSession {
+	return &ClientSession{
+		ClientSession: session,
+		config:        config,
+	}
+}
+
+func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	return s.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext passes ctx on if the wrapped session takes one.
+func (s *ClientSession) OpenStreamContext(ctx context.Context) (netx.Stream, error) {
+	var stream netx.Stream
+	var err error
+	if opener, ok := s.ClientSession.(netx.ContextOpener); ok {
+		stream, err = opener.OpenStreamContext(ctx)
+	} else {
+		stream, err = s.ClientSession.OpenStream()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapStream(stream, s.config), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net"
+	"proxy-bench/netx"
+)
+
+// spliceChunk is how many bytes spliceFrom relays between updating the
+// counters.
+const spliceChunk = 256 * 1024
+
+// spliceEnabled is whether relays between plain TCP connections use
+// spliceFrom.
+var spliceEnabled = true
+
+// spliceConns returns the TCP connections beneath r and s if the bytes may go
+// from one to the other directly. That's only the case if nothing but s has to
+// see every write: no rate limits, which wrap the stream, and no idle timer,
+// which would only be touched every spliceChunk.
+func (s *countingStream) spliceConns(r io.Reader) (src, dst *net.TCPConn, ok bool) {
+	if !spliceEnabled || s.idle != nil {
+		return nil, nil, false
+	}
+
+	srcStream, ok := r.(netx.ConnStream)
+	if !ok {
+		return nil, nil, false
+	}
+	dstStream, ok := s.Stream.(netx.ConnStream)
+	if !ok {
+		return nil, nil, false
+	}
+
+	src, ok = srcStream.NetConn().(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	dst, ok = dstStream.NetConn().(*net.TCPConn)
+
+	return src, dst, ok
+}
+
+// spliceFrom relays src to dst like io.Copy, which moves the bytes within the
+// kernel with splice(2) on Linux. The first read still goes through s so the
+// time of the first byte is exact, later bytes are counted every spliceChunk.
+func (s *countingStream) spliceFrom(src, dst *net.TCPConn) (written int64, err error) {
+	buf := make([]byte, 32*1024)
+	n, err := src.Read(buf)
+	if n > 0 {
+		var nw int
+		nw, err = s.Write(buf[:n])
+		written += int64(nw)
+	}
+	if err == io.EOF {
+		return written, nil
+	}
+	if err != nil {
+		return written, err
+	}
+
+	// TCPConn.ReadFrom splices from an io.LimitedReader of a TCPConn as
+	// well, and reads until src ends or it's used up.
+	limited := &io.LimitedReader{R: src}
+	for {
+		limited.N = spliceChunk
+		n, err := dst.ReadFrom(limited)
+		s.count(n)
+		written += n
+		if err != nil || n < spliceChunk {
+			return written, err
+		}
+	}
+}
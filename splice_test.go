@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"proxy-bench/metrics"
+	"testing"
+)
+
+// relaySize is how many bytes every iteration relays.
+const relaySize = 64 * 1024 * 1024
+
+func BenchmarkRelayTCP(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkRelayTCP(b, true)
+	})
+	b.Run("copy", func(b *testing.B) {
+		benchmarkRelayTCP(b, false)
+	})
+}
+
+// benchmarkRelayTCP relays between loopback TCP connections like the proxy
+// does, with or without splice(2).
+func benchmarkRelayTCP(b *testing.B, splice bool) {
+	defer func(enabled bool) {
+		spliceEnabled = enabled
+	}(spliceEnabled)
+	spliceEnabled = splice
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(relaySize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		in, src := tcpPair(b)
+		dst, out := tcpPair(b)
+		b.StartTimer()
+
+		go func() {
+			defer in.Close()
+			for n := 0; n < relaySize; n += len(chunk) {
+				if _, err := in.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+
+		received := make(chan int64, 1)
+		go func() {
+			n, _ := io.Copy(io.Discard, out)
+			received <- n
+		}()
+
+		down := newCountingStream(&stdStream{ReadWriteCloser: dst}, metrics.Bytes.WithLabelValues("downstream"))
+		_, err := copyStream(&stdStream{ReadWriteCloser: src}, down, "src", "dst", 0)
+		if err != nil {
+			b.Fatalf("relay error: %v", err)
+		}
+		if n := <-received; n != relaySize {
+			b.Fatalf("received %d bytes, want %d", n, relaySize)
+		}
+
+		src.Close()
+		dst.Close()
+		out.Close()
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(b *testing.B) (client, server *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("listen error: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("dial error: %v", err)
+	}
+
+	accept := <-accepted
+	if accept == nil {
+		b.Fatalf("accept failed")
+	}
+
+	return conn.(*net.TCPConn), accept.(*net.TCPConn)
+}
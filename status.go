@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"proxy-bench/metrics"
+	"runtime"
+	"time"
+)
+
+// statusInterval is how often the status line is printed.
+const statusInterval = time.Second
+
+// statusSample is a reading of the relay counters.
+type statusSample struct {
+	time      time.Time
+	bytesUp   float64
+	bytesDown float64
+	accepted  float64
+	failed    float64
+	active    float64
+	cpu       float64
+}
+
+func readStatus(listenScheme, connectScheme string) statusSample {
+	return statusSample{
+		time:      time.Now(),
+		bytesUp:   metrics.Value(metrics.Bytes.WithLabelValues("upstream")),
+		bytesDown: metrics.Value(metrics.Bytes.WithLabelValues("downstream")),
+		accepted:  metrics.Value(metrics.StreamsAccepted.WithLabelValues(listenScheme)),
+		failed: metrics.Value(metrics.StreamsFailed.WithLabelValues(connectScheme, "open")) +
+			metrics.Value(metrics.StreamsFailed.WithLabelValues(connectScheme, "copy")),
+		active: metrics.Value(metrics.ActiveStreams),
+		cpu:    readCPUSeconds(),
+	}
+}
+
+// printStatus prints a compact line with the throughput of the last interval
+// and the totals so far every statusInterval, e.g.
+//
+//	15:04:05 tcp->capnp up 95.31 MiB/s down 95.12 MiB/s | 1.20 GiB up 1.20 GiB down | streams 8 active 120 total 0 failed | goroutines 84 | cpu 97%
+func printStatus(w io.Writer, listenScheme, connectScheme string) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	last := readStatus(listenScheme, connectScheme)
+	for range ticker.C {
+		now := readStatus(listenScheme, connectScheme)
+		elapsed := now.time.Sub(last.time).Seconds()
+
+		fmt.Fprintf(w, "%s %s->%s up %s/s down %s/s | %s up %s down | streams %.0f active %.0f total %.0f failed | goroutines %d | cpu %.0f%%\n",
+			now.time.Format(time.TimeOnly), listenScheme, connectScheme,
+			formatBytes((now.bytesUp-last.bytesUp)/elapsed), formatBytes((now.bytesDown-last.bytesDown)/elapsed),
+			formatBytes(now.bytesUp), formatBytes(now.bytesDown),
+			now.active, now.accepted, now.failed,
+			runtime.NumGoroutine(),
+			(now.cpu-last.cpu)/elapsed*100)
+
+		last = now
+	}
+}
+
+// formatBytes formats a byte count with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for n >= 1024 && unit < len(units)-1 {
+		n /= 1024
+		unit++
+	}
+
+	return fmt.Sprintf("%.2f %s", n, units[unit])
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
+	"proxy-bench/memnet"
 	"proxy-bench/netx"
 )
 
@@ -21,7 +22,7 @@ func (s *stdServerSession) AcceptStream() (netx.Stream, error) {
 		return nil, err
 	}
 
-	log.Printf("Accepted stream: %s->%s", conn.RemoteAddr(), conn.LocalAddr())
+	logger.Debug().Stringer("remote", conn.RemoteAddr()).Stringer("local", conn.LocalAddr()).Msg("Accepted stream")
 
 	return &stdStream{
 		ReadWriteCloser: conn,
@@ -33,26 +34,20 @@ func (s *stdServerSession) Close() error {
 }
 
 type stdClientSession struct {
-	network   string
-	address   string
-	tlsConfig *tls.Config
+	dial netx.Dialer
 }
 
 func (s *stdClientSession) OpenStream() (netx.Stream, error) {
-	var conn net.Conn
-	var err error
-
-	if s.tlsConfig == nil {
-		conn, err = net.Dial(s.network, s.address)
-	} else {
-		conn, err = tls.Dial(s.network, s.address, s.tlsConfig)
-	}
+	return s.OpenStreamContext(context.Background())
+}
 
+func (s *stdClientSession) OpenStreamContext(ctx context.Context) (netx.Stream, error) {
+	conn, err := s.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Opened stream: %s->%s", conn.LocalAddr(), conn.RemoteAddr())
+	logger.Debug().Stringer("local", conn.LocalAddr()).Stringer("remote", conn.RemoteAddr()).Msg("Opened stream")
 
 	return &stdStream{
 		ReadWriteCloser: conn,
@@ -67,6 +62,18 @@ type stdStream struct {
 	io.ReadWriteCloser
 }
 
+func (s *stdStream) NetConn() net.Conn {
+	return s.ReadWriteCloser.(net.Conn)
+}
+
+func (s *stdStream) LocalAddr() net.Addr {
+	return s.ReadWriteCloser.(net.Conn).LocalAddr()
+}
+
+func (s *stdStream) RemoteAddr() net.Addr {
+	return s.ReadWriteCloser.(net.Conn).RemoteAddr()
+}
+
 func (s *stdStream) CloseRead() error {
 	if c, ok := s.ReadWriteCloser.(interface {
 		CloseRead() error
@@ -90,30 +97,45 @@ func (s *stdStream) CloseWrite() error {
 func getClientTLSConfig(args Args) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
 		NextProtos: []string{"h2"},
+		ServerName: args.TLS.ServerName,
+
+		VerifyConnection: observeHandshake,
+	}
+	args.TLS.apply(tlsConfig)
+	if args.Pins != nil {
+		args.Pins.apply(tlsConfig)
+	}
+
+	if args.TLS.SessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = getClientSessionCache(args.TLS.SessionCacheSize)
 	}
 
 	if args.CAPath != "" {
-		caCert, err := os.ReadFile(args.CAPath)
+		caPool, err := loadCertPool(args.CAPath)
 		if err != nil {
 			return nil, err
 		}
 
-		caPool := x509.NewCertPool()
-		if !caPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to AppendCertsFromPEM: %s", args.CAPath)
+		tlsConfig.RootCAs = caPool
+	}
+
+	if args.ClientCertPath != "" {
+		reloader, err := getCertReloader(args.ClientCertPath, args.ClientKeyPath, args.CertReload)
+		if err != nil {
+			return nil, err
 		}
 
-		tlsConfig.RootCAs = caPool
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
 	}
 
 	keylog := os.Getenv("SSLKEYLOGFILE")
 	if keylog != "" {
 		file, err := os.OpenFile(keylog, os.O_CREATE|os.O_RDWR, 0664)
 		if err != nil {
-			log.Printf("Failed to open SSLKEYLOGFILE(%s): %v", keylog, err)
+			logger.Error().Err(err).Str("path", keylog).Msg("Failed to open SSLKEYLOGFILE")
 		} else {
 			tlsConfig.KeyLogWriter = file
-			log.Printf("Success to set TLS KeyLogWriter to %s", keylog)
+			logger.Info().Str("path", keylog).Msg("Success to set TLS KeyLogWriter")
 		}
 	}
 
@@ -121,78 +143,84 @@ func getClientTLSConfig(args Args) (*tls.Config, error) {
 }
 
 func getServerTLSConfig(args Args) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(args.CertPath, args.KeyPath)
+	reloader, err := getCertReloader(args.CertPath, args.KeyPath, args.CertReload)
 	if err != nil {
-		log.Fatalf("Failed to load certificate: %v", err)
+		logger.Fatal().Err(err).Msg("Failed to load certificate")
 	}
 
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.NoClientCert,
-		NextProtos:   []string{"h2"},
+		GetCertificate: reloader.GetCertificate,
+		ClientAuth:     tls.NoClientCert,
+		NextProtos:     []string{"h2"},
+
+		SessionTicketsDisabled: args.TLS.SessionTicketsDisabled,
+	}
+	args.TLS.apply(tlsConfig)
+
+	if args.ClientCAPath != "" {
+		caPool, err := loadCertPool(args.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = caPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
 	keylog := os.Getenv("SSLKEYLOGFILE")
 	if keylog != "" {
 		file, err := os.OpenFile(keylog, os.O_CREATE|os.O_RDWR, 0664)
 		if err != nil {
-			log.Printf("Failed to open SSLKEYLOGFILE(%s): %v", keylog, err)
+			logger.Error().Err(err).Str("path", keylog).Msg("Failed to open SSLKEYLOGFILE")
 		} else {
 			tlsConfig.KeyLogWriter = file
-			log.Printf("Success to set TLS KeyLogWriter to %s", keylog)
+			logger.Info().Str("path", keylog).Msg("Success to set TLS KeyLogWriter")
 		}
 	}
 
 	return tlsConfig, nil
 }
 
-func init() {
-	netListen := func(args Args) (netx.ServerSession, error) {
-		var listener net.Listener
-		var err error
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caCert, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-		network, tlsEnabled, addr := splitAddress(args.Listen)
-		if tlsEnabled {
-			tlsConfig, err1 := getServerTLSConfig(args)
-			if err1 != nil {
-				return nil, err1
-			}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to AppendCertsFromPEM: %s", path)
+	}
 
-			listener, err = tls.Listen(network, addr, tlsConfig)
-		} else {
-			listener, err = net.Listen(network, addr)
-		}
+	return caPool, nil
+}
 
+func init() {
+	netListen := func(args Args) (netx.ServerSession, error) {
+		network, _, _ := splitAddress(args.Listen)
+		listener, err := listenTLSConn(args, network, args.Listen)
 		if err != nil {
 			return nil, err
 		}
 
-		log.Printf("Listened on %s", args.Listen)
-
 		return &stdServerSession{
 			listener: listener,
 		}, nil
 	}
 
 	netDial := func(args Args) (netx.ClientSession, error) {
-		network, tlsEnabled, addr := splitAddress(args.Connect)
-		sess := &stdClientSession{
-			network: network,
-			address: addr,
-		}
-
-		if tlsEnabled {
-			tlsConfig, err := getClientTLSConfig(args)
-			if err != nil {
-				return nil, err
-			}
-			sess.tlsConfig = tlsConfig
+		network, _, _ := splitAddress(args.Connect)
+		dial, err := newTLSDialer(args, network, args.Connect)
+		if err != nil {
+			return nil, err
 		}
 
-		return sess, nil
+		return &stdClientSession{
+			dial: dial,
+		}, nil
 	}
 
-	for _, scheme := range []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket"} {
+	for _, scheme := range []string{"tcp", "tcp4", "tcp6", "unix", "unixpacket", memnet.Network} {
 		serverSessionCreators[scheme] = netListen
 		clientSessionCreators[scheme] = netDial
 	}
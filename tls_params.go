@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"proxy-bench/metrics"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TLSParams override Go's TLS defaults for every transport, on both sides.
+type TLSParams struct {
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites only apply up to TLS 1.2, TLS 1.3 suites are not
+	// configurable in Go.
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// SessionTicketsDisabled turns off session resumption on the server.
+	SessionTicketsDisabled bool
+	// SessionCacheSize is the size of the client session cache shared by all
+	// client sessions, zero disables resumption on the client.
+	SessionCacheSize int
+	// ServerName is the SNI sent by clients, taken from the connect address
+	// if empty.
+	ServerName string
+}
+
+func (p TLSParams) apply(tlsConfig *tls.Config) {
+	tlsConfig.MinVersion = p.MinVersion
+	tlsConfig.MaxVersion = p.MaxVersion
+	tlsConfig.CipherSuites = p.CipherSuites
+	tlsConfig.CurvePreferences = p.CurvePreferences
+}
+
+func parseTLSParams(minVersion, maxVersion, ciphers, curves string) (params TLSParams, err error) {
+	params.MinVersion, err = parseTLSVersion(minVersion)
+	if err != nil {
+		return
+	}
+	params.MaxVersion, err = parseTLSVersion(maxVersion)
+	if err != nil {
+		return
+	}
+	params.CipherSuites, err = parseCipherSuites(ciphers)
+	if err != nil {
+		return
+	}
+	params.CurvePreferences, err = parseCurves(curves)
+	return
+}
+
+var (
+	sessionCacheOnce sync.Once
+	sessionCache     tls.ClientSessionCache
+)
+
+// getClientSessionCache returns the process wide client session cache, so
+// sessions survive reconnects and new client sessions.
+func getClientSessionCache(size int) tls.ClientSessionCache {
+	sessionCacheOnce.Do(func() {
+		sessionCache = tls.NewLRUClientSessionCache(size)
+	})
+
+	return sessionCache
+}
+
+// observeHandshake is a tls.Config.VerifyConnection which logs and counts
+// what each client handshake negotiated, for every transport alike.
+func observeHandshake(state tls.ConnectionState) error {
+	metrics.TLSHandshakes.WithLabelValues(strconv.FormatBool(state.DidResume)).Inc()
+	logger.Debug().
+		Str("version", tls.VersionName(state.Version)).
+		Str("cipher", tls.CipherSuiteName(state.CipherSuite)).
+		Stringer("curve", state.CurveID).
+		Bool("resumed", state.DidResume).
+		Msg("Success to handshake")
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses 1.0 to 1.3, empty is the Go default.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, available: 1.0, 1.1, 1.2, 1.3", s)
+	}
+
+	return version, nil
+}
+
+// parseCipherSuites parses a comma separated list of Go cipher suite names,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure ones are accepted too,
+// it's a benchmark.
+func parseCipherSuites(s string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range splitList(s) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+var knownCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// parseCurves parses a comma separated list of key exchanges in order of
+// preference, e.g. X25519MLKEM768,X25519. P256 is short for CurveP256.
+func parseCurves(s string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range splitList(s) {
+		found := false
+		for _, curve := range knownCurves {
+			if curve.String() == name || curve.String() == "Curve"+name {
+				ids = append(ids, curve)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown curve %q, available: X25519MLKEM768, X25519, P256, P384, P521", name)
+		}
+	}
+
+	return ids, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errPinMismatch = errors.New("server certificate matches no pin")
+
+// certPins pin the server of client sessions to certificates or public keys,
+// by their SHA-256 hashes.
+type certPins struct {
+	spki  map[[sha256.Size]byte]bool
+	certs map[[sha256.Size]byte]bool
+	// only skips CA validation, the leaf certificate must match a pin then.
+	// Otherwise any certificate of the verified chain may, like pinning an
+	// intermediate CA.
+	only bool
+}
+
+// parsePins parses comma separated SHA-256 hashes of public keys (the DER
+// SubjectPublicKeyInfo) and of certificates, in base64 or hex with optional
+// colons. It returns nil if there are none.
+func parsePins(spki, certs string, only bool) (*certPins, error) {
+	pins := &certPins{
+		spki:  make(map[[sha256.Size]byte]bool),
+		certs: make(map[[sha256.Size]byte]bool),
+		only:  only,
+	}
+
+	for _, list := range []struct {
+		s      string
+		hashes map[[sha256.Size]byte]bool
+	}{{spki, pins.spki}, {certs, pins.certs}} {
+		for _, pin := range splitList(list.s) {
+			hash, err := parsePinHash(pin)
+			if err != nil {
+				return nil, err
+			}
+
+			list.hashes[hash] = true
+		}
+	}
+
+	if len(pins.spki) == 0 && len(pins.certs) == 0 {
+		if only {
+			return nil, errors.New("skipping CA validation needs a pin")
+		}
+		return nil, nil
+	}
+
+	return pins, nil
+}
+
+func parsePinHash(pin string) (hash [sha256.Size]byte, err error) {
+	b, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(b) != sha256.Size {
+		b, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(b) != sha256.Size {
+		return hash, fmt.Errorf("pin %q is no SHA-256 hash in base64 or hex", pin)
+	}
+
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// spkiPin is the base64 SHA-256 hash of the public key of cert, as taken by
+// -pin-spki.
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (p *certPins) apply(tlsConfig *tls.Config) {
+	// The pins are checked in VerifyConnection instead.
+	tlsConfig.InsecureSkipVerify = p.only
+
+	observe := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		err := p.verify(state)
+		if err != nil {
+			return err
+		}
+
+		return observe(state)
+	}
+}
+
+func (p *certPins) verify(state tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	if p.only {
+		certs = state.PeerCertificates[:min(len(state.PeerCertificates), 1)]
+	} else {
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	for _, cert := range certs {
+		if p.spki[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] || p.certs[sha256.Sum256(cert.Raw)] {
+			return nil
+		}
+	}
+
+	return errPinMismatch
+}
@@ -0,0 +1,376 @@
+package tracex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A minimal tracer writing spans in the OTLP JSON file format: one
+// ExportTraceServiceRequest per line, which the OpenTelemetry collector's
+// otlpjsonfile receiver and most trace viewers can read.
+
+const serviceName = "proxy-bench"
+
+const (
+	flushInterval = time.Second
+	flushSize     = 512
+)
+
+type SpanKind int
+
+// Values of the OTLP SpanKind enum.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type Tracer struct {
+	sample float64
+
+	mu      sync.Mutex
+	w       io.WriteCloser
+	pending []*Span
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+var tracer atomic.Pointer[Tracer]
+
+// Enable starts writing spans to the file at path, tracing the given ratio of
+// root spans with all of their children.
+func Enable(path string, sample float64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	t := &Tracer{
+		sample: sample,
+		w:      file,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go t.flushLoop()
+
+	tracer.Store(t)
+	return nil
+}
+
+// Shutdown writes out the pending spans and stops tracing.
+func Shutdown() error {
+	t := tracer.Swap(nil)
+	if t == nil {
+		return nil
+	}
+
+	close(t.stopCh)
+	<-t.doneCh
+	return t.w.Close()
+}
+
+func (t *Tracer) flushLoop() {
+	defer close(t.doneCh)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stopCh:
+			t.flush()
+			return
+		}
+	}
+}
+
+func (t *Tracer) add(span *Span) {
+	t.mu.Lock()
+	t.pending = append(t.pending, span)
+	full := len(t.pending) >= flushSize
+	t.mu.Unlock()
+
+	if full {
+		t.flush()
+	}
+}
+
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) == 0 {
+		return
+	}
+
+	spans := make([]jsonSpan, len(t.pending))
+	for i, span := range t.pending {
+		spans[i] = span.toJSON()
+	}
+	t.pending = t.pending[:0]
+
+	data, err := json.Marshal(jsonRequest{
+		ResourceSpans: []jsonResourceSpans{{
+			Resource: jsonResource{
+				Attributes: []jsonAttribute{stringAttribute("service.name", serviceName)},
+			},
+			ScopeSpans: []jsonScopeSpans{{
+				Scope: jsonScope{Name: serviceName},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err == nil {
+		_, err = t.w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write spans: %v\n", err)
+	}
+}
+
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []jsonAttribute
+	events     []jsonEvent
+	err        error
+}
+
+type spanKey struct{}
+
+// unsampled marks contexts below a root span which was not sampled, so its
+// children are not traced either.
+var unsampled = &Span{}
+
+// Start starts a span as child of the one in ctx, or as a new trace root. It
+// returns a nil span, on which all methods do nothing, if tracing is disabled
+// or the trace was not sampled.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return StartAt(ctx, name, kind, time.Now())
+}
+
+// StartAt is Start for a span which started at the given time.
+func StartAt(ctx context.Context, name string, kind SpanKind, start time.Time) (context.Context, *Span) {
+	t := tracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent, _ := ctx.Value(spanKey{}).(*Span)
+	if parent == unsampled {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  start,
+	}
+	rand.Read(span.spanID[:])
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		if mathrand.Float64() >= t.sample {
+			return context.WithValue(ctx, spanKey{}, unsampled), nil
+		}
+		rand.Read(span.traceID[:])
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute sets an attribute of type string, bool, int, int64 or float64.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attribute(key, value))
+}
+
+func (s *Span) AddEvent(name string) {
+	s.AddEventAt(name, time.Now())
+}
+
+func (s *Span) AddEventAt(name string, t time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, jsonEvent{
+		TimeUnixNano: unixNano(t),
+		Name:         name,
+	})
+}
+
+// SetError marks the span as failed, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End ends the span and queues it for writing. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !ended {
+		s.tracer.add(s)
+	}
+}
+
+func (s *Span) toJSON() jsonSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := jsonSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        s.attributes,
+		Events:            s.events,
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		span.Status = &jsonStatus{
+			Code:    statusError,
+			Message: s.err.Error(),
+		}
+	}
+
+	return span
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+const statusError = 2
+
+type jsonRequest struct {
+	ResourceSpans []jsonResourceSpans `json:"resourceSpans"`
+}
+
+type jsonResourceSpans struct {
+	Resource   jsonResource     `json:"resource"`
+	ScopeSpans []jsonScopeSpans `json:"scopeSpans"`
+}
+
+type jsonResource struct {
+	Attributes []jsonAttribute `json:"attributes"`
+}
+
+type jsonScopeSpans struct {
+	Scope jsonScope  `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type jsonScope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []jsonAttribute `json:"attributes,omitempty"`
+	Events            []jsonEvent     `json:"events,omitempty"`
+	Status            *jsonStatus     `json:"status,omitempty"`
+}
+
+type jsonEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type jsonStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonAttribute struct {
+	Key   string    `json:"key"`
+	Value jsonValue `json:"value"`
+}
+
+// jsonValue is an OTLP AnyValue, 64 bit integers are encoded as strings.
+type jsonValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func stringAttribute(key, value string) jsonAttribute {
+	return jsonAttribute{Key: key, Value: jsonValue{StringValue: &value}}
+}
+
+func attribute(key string, value any) jsonAttribute {
+	switch v := value.(type) {
+	case string:
+		return stringAttribute(key, v)
+	case bool:
+		return jsonAttribute{Key: key, Value: jsonValue{BoolValue: &v}}
+	case int:
+		s := strconv.Itoa(v)
+		return jsonAttribute{Key: key, Value: jsonValue{IntValue: &s}}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return jsonAttribute{Key: key, Value: jsonValue{IntValue: &s}}
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		return jsonAttribute{Key: key, Value: jsonValue{IntValue: &s}}
+	case float64:
+		return jsonAttribute{Key: key, Value: jsonValue{DoubleValue: &v}}
+	default:
+		return stringAttribute(key, fmt.Sprint(v))
+	}
+}
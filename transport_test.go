@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"proxy-bench/netx"
+	"testing"
+)
+
+// transports are run in-process over mem addresses, except quic which only
+// runs over UDP.
+var transports = []struct {
+	name   string
+	scheme string
+	tls    bool
+}{
+	{name: "std", scheme: "mem://%s"},
+	{name: "std+tls", scheme: "mem+tls://%s", tls: true},
+	{name: "capnp", scheme: "capnp+mem://%s"},
+	{name: "grpc", scheme: "grpc+mem://%s"},
+	{name: "mux", scheme: "mux+mem://%s"},
+	{name: "ws", scheme: "ws+mem://%s/"},
+	{name: "ws mux", scheme: "ws+mem://%s/?mux=1"},
+	{name: "h2", scheme: "h2+mem://%s"},
+	{name: "quic", scheme: "quic://%s", tls: true},
+}
+
+// payloadSize is larger than the stream windows of the multiplexed
+// transports, so flow control is exercised too.
+const payloadSize = 1024 * 1024
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(stream netx.Stream) error
+		run    func(t *testing.T, stream netx.Stream, payload []byte)
+	}{{
+		name: "round trip",
+		handle: func(stream netx.Stream) error {
+			_, err := copyStream(stream, stream, "echo", "echo", 0)
+			return err
+		},
+		run: func(t *testing.T, stream netx.Stream, payload []byte) {
+			errs := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(payload)
+				errs <- err
+				stream.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("write error: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("read %d bytes back, want the %d written", len(got), len(payload))
+			}
+		},
+	}, {
+		// The server only answers once the client closed its write side, then
+		// closes its own.
+		name: "half close",
+		handle: func(stream netx.Stream) error {
+			request, err := io.ReadAll(stream)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(stream, "%d", len(request))
+			if err != nil {
+				return err
+			}
+
+			return stream.CloseWrite()
+		},
+		run: func(t *testing.T, stream netx.Stream, payload []byte) {
+			if _, err := stream.Write(payload); err != nil {
+				t.Fatalf("write error: %v", err)
+			}
+			if err := stream.CloseWrite(); err != nil {
+				t.Fatalf("close write error: %v", err)
+			}
+
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if want := fmt.Sprint(len(payload)); string(got) != want {
+				t.Fatalf("read %q, want %q", got, want)
+			}
+		},
+	}}
+
+	certDir := t.TempDir()
+	runGenCert([]string{"-dir", certDir, "-key-type", "ecdsa"})
+
+	payload := make([]byte, payloadSize)
+	rand.Read(payload)
+
+	for i, transport := range transports {
+		for j, test := range tests {
+			t.Run(transport.name+"/"+test.name, func(t *testing.T) {
+				name := fmt.Sprintf("transport-%d-%d", i, j)
+				if transport.scheme == "quic://%s" {
+					name = freeUDPAddress(t)
+				}
+				address := fmt.Sprintf(transport.scheme, name)
+
+				var args Args
+				if transport.tls {
+					args = Args{
+						CertPath: filepath.Join(certDir, "server-cert.pem"),
+						KeyPath:  filepath.Join(certDir, "server-key.pem"),
+						CAPath:   filepath.Join(certDir, "ca.pem"),
+					}
+				}
+				args.Listen = address
+				args.Connect = address
+
+				server := newServerSession(args)
+				defer server.Close()
+				client := newClientSession(args)
+				defer client.Close()
+
+				handled := make(chan error, 1)
+				go func() {
+					stream, err := server.AcceptStream()
+					if err != nil {
+						handled <- err
+						return
+					}
+					defer stream.Close()
+
+					handled <- test.handle(stream)
+				}()
+
+				stream, err := client.OpenStream()
+				if err != nil {
+					t.Fatalf("open error: %v", err)
+				}
+				defer stream.Close()
+
+				test.run(t, stream, payload)
+				if err := <-handled; err != nil {
+					t.Fatalf("server error: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// freeUDPAddress is a loopback address nothing listens on.
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/url"
+	"proxy-bench/netx"
+	"proxy-bench/wsnet"
+	"strconv"
+	"strings"
+)
+
+// splitWSAddress splits a WebSocket address into its URL and the address of
+// the connection underneath, e.g. ws+mem://name for ws+mem://name/?mux=1.
+func splitWSAddress(address string) (u *url.URL, connAddress string, tlsEnabled bool, err error) {
+	network, tlsEnabled, addr := splitAddress(address)
+	tlsEnabled = tlsEnabled || network == "wss"
+
+	u, err = url.Parse("ws://" + addr)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if tlsEnabled {
+		u.Scheme = "wss"
+	}
+
+	scheme, _, _ := strings.Cut(address, "://")
+	return u, scheme + "://" + u.Host, tlsEnabled, nil
+}
+
+func init() {
+	for _, scheme := range []string{"ws", "wss"} {
+		serverSessionCreators[scheme] = func(args Args) (netx.ServerSession, error) {
+			_, connAddress, tlsEnabled, err := splitWSAddress(args.Listen)
+			if err != nil {
+				return nil, err
+			}
+
+			var tlsConfig *tls.Config
+			if tlsEnabled {
+				tlsConfig, err = getServerTLSConfig(args)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			listener, err := listenConn(args, "tcp", connAddress)
+			if err != nil {
+				return nil, err
+			}
+
+			return wsnet.NewServerSession(listener, tlsConfig, args.KeepAlive), nil
+		}
+
+		clientSessionCreators[scheme] = func(args Args) (netx.ClientSession, error) {
+			u, connAddress, tlsEnabled, err := splitWSAddress(args.Connect)
+			if err != nil {
+				return nil, err
+			}
+
+			var tlsConfig *tls.Config
+			if tlsEnabled {
+				tlsConfig, err = getClientTLSConfigFor(args, connAddress)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			dial, err := newDialer(args, "tcp", connAddress)
+			if err != nil {
+				return nil, err
+			}
+			if mux, _ := strconv.ParseBool(u.Query().Get("mux")); mux {
+				dial = countReconnects(scheme, dial)
+			}
+
+			return wsnet.NewClientSession(u.String(), dial, tlsConfig, args.KeepAlive)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package wsnet
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"proxy-bench/netx"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every binary message of a multiplexed connection is one frame: a one byte
+// frame type and a big endian stream ID, followed by the payload. The payload
+// of a window update is the big endian credit granted to the peer.
+const (
+	frameOpen byte = iota
+	frameData
+	frameFin
+	frameWindow
+
+	frameHeaderSize = 5
+)
+
+const (
+	// initialWindow is the receive window of every stream. A window update is
+	// sent once half of it was consumed.
+	initialWindow = 256 * 1024
+	maxFrameSize  = 64 * 1024
+)
+
+// muxConn multiplexes streams over a single WebSocket connection. Every
+// stream buffers up to its receive window, so a stream nobody reads from
+// only stalls its own writer. Both sides ping as set by keepAlive, and fail
+// the connection once nothing, not even a pong, was read for the interval
+// plus the timeout.
+type muxConn struct {
+	conn      *websocket.Conn
+	keepAlive netx.KeepAlive
+	accept    func(netx.Stream)
+	writeMu   sync.Mutex
+	mu        sync.Mutex
+	streams   map[uint32]*muxStream
+	nextID    uint32
+	closed    atomic.Bool
+}
+
+func newMuxConn(conn *websocket.Conn, keepAlive netx.KeepAlive, accept func(netx.Stream)) *muxConn {
+	return &muxConn{
+		conn:      conn,
+		keepAlive: keepAlive,
+		accept:    accept,
+		streams:   make(map[uint32]*muxStream),
+	}
+}
+
+func (m *muxConn) isClosed() bool {
+	return m.closed.Load()
+}
+
+func (m *muxConn) openStream() (*muxStream, error) {
+	m.mu.Lock()
+	m.nextID++
+	stream := m.addStreamLocked(m.nextID)
+	m.mu.Unlock()
+
+	err := m.writeFrame(frameOpen, stream.id, nil)
+	if err != nil {
+		m.removeStream(stream.id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (m *muxConn) addStreamLocked(id uint32) *muxStream {
+	stream := &muxStream{
+		mux:        m,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	m.streams[id] = stream
+	return stream
+}
+
+func (m *muxConn) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *muxConn) removeStream(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *muxConn) writeFrame(frameType byte, id uint32, payload []byte) error {
+	var header [frameHeaderSize]byte
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], id)
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	w, err := m.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(header[:])
+	if err == nil && len(payload) > 0 {
+		_, err = w.Write(payload)
+	}
+
+	return errors.Join(err, w.Close())
+}
+
+// writeWindow grants credit to the peer's side of a stream.
+func (m *muxConn) writeWindow(id, credit uint32) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], credit)
+	return m.writeFrame(frameWindow, id, payload[:])
+}
+
+// run reads frames until the connection fails, then fails every stream still
+// open on it.
+func (m *muxConn) run() error {
+	if m.keepAlive.Interval > 0 {
+		m.extendReadDeadline()
+		m.conn.SetPongHandler(func(string) error {
+			m.extendReadDeadline()
+			return nil
+		})
+		go m.ping()
+	}
+
+	err := m.readFrames()
+
+	m.closed.Store(true)
+	m.conn.Close()
+
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(io.ErrUnexpectedEOF)
+	}
+
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return nil
+	}
+
+	return err
+}
+
+func (m *muxConn) readFrames() error {
+	for {
+		messageType, data, err := m.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		m.extendReadDeadline()
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if len(data) < frameHeaderSize {
+			return fmt.Errorf("short frame of %d bytes", len(data))
+		}
+
+		frameType := data[0]
+		id := binary.BigEndian.Uint32(data[1:frameHeaderSize])
+		payload := data[frameHeaderSize:]
+
+		if frameType == frameOpen {
+			m.mu.Lock()
+			stream := m.addStreamLocked(id)
+			m.mu.Unlock()
+
+			m.accept(stream)
+			continue
+		}
+
+		stream := m.stream(id)
+		if stream == nil {
+			// Frames for streams closed locally are dropped, still returning
+			// their credit so the peer is never blocked on it.
+			if frameType == frameData && len(payload) > 0 {
+				go m.writeWindow(id, uint32(len(payload)))
+			}
+			continue
+		}
+
+		switch frameType {
+		case frameData:
+			err = stream.receive(payload)
+		case frameFin:
+			stream.receiveFIN()
+		case frameWindow:
+			if len(payload) != 4 {
+				return fmt.Errorf("window update of %d bytes", len(payload))
+			}
+			stream.addSendWindow(binary.BigEndian.Uint32(payload))
+		default:
+			return fmt.Errorf("unknown frame type %d", frameType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *muxConn) extendReadDeadline() {
+	if m.keepAlive.Interval > 0 {
+		m.conn.SetReadDeadline(time.Now().Add(m.keepAlive.Interval + cmp.Or(m.keepAlive.Timeout, m.keepAlive.Interval)))
+	}
+}
+
+// ping runs until the connection is closed, pongs are answered by the
+// default ping handler of the peer.
+func (m *muxConn) ping() {
+	ticker := time.NewTicker(m.keepAlive.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if m.isClosed() {
+			return
+		}
+
+		err := m.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(controlWait))
+		if err != nil {
+			return
+		}
+	}
+}
+
+type muxStream struct {
+	mux *muxConn
+	id  uint32
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	recvBuf     bytes.Buffer
+	recvWindow  uint32
+	consumed    uint32
+	sendWindow  uint32
+	finRecv     bool
+	readClosed  bool
+	writeClosed bool
+	err         error
+}
+
+func (s *muxStream) Read(p []byte) (n int, err error) {
+	s.mu.Lock()
+	for s.recvBuf.Len() == 0 && !s.finRecv && !s.readClosed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.recvBuf.Len() == 0 {
+		defer s.mu.Unlock()
+		switch {
+		case s.readClosed:
+			return 0, io.ErrClosedPipe
+		case s.finRecv:
+			return 0, io.EOF
+		}
+		return 0, s.err
+	}
+
+	n, _ = s.recvBuf.Read(p)
+	credit := s.consume(uint32(n))
+	s.mu.Unlock()
+
+	if credit > 0 {
+		err = s.mux.writeWindow(s.id, credit)
+	}
+
+	return n, err
+}
+
+// consume accounts n read bytes and returns the credit to grant to the peer,
+// if it's time to send a window update.
+func (s *muxStream) consume(n uint32) uint32 {
+	s.consumed += n
+	if s.consumed < initialWindow/2 {
+		return 0
+	}
+
+	credit := s.consumed
+	s.consumed = 0
+	s.recvWindow += credit
+	return credit
+}
+
+func (s *muxStream) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.writeClosed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.writeClosed {
+			s.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return n, s.err
+		}
+
+		chunk := min(uint32(len(p)-n), s.sendWindow, maxFrameSize)
+		s.sendWindow -= chunk
+		s.mu.Unlock()
+
+		err = s.mux.writeFrame(frameData, s.id, p[n:n+int(chunk)])
+		if err != nil {
+			return n, err
+		}
+
+		n += int(chunk)
+	}
+
+	return n, nil
+}
+
+// Close finishes the write side and drops the stream. A peer still sending
+// has its frames discarded.
+func (s *muxStream) Close() error {
+	err := errors.Join(s.CloseWrite(), s.CloseRead())
+	s.mux.removeStream(s.id)
+	return err
+}
+
+// CloseRead discards buffered and further incoming data, still returning
+// window credit so the peer is never blocked on it.
+func (s *muxStream) CloseRead() error {
+	s.mu.Lock()
+	if s.readClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.readClosed = true
+	credit := uint32(s.recvBuf.Len()) + s.consumed
+	s.recvBuf.Reset()
+	s.consumed = 0
+	s.recvWindow += credit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if credit > 0 && !s.mux.isClosed() {
+		return s.mux.writeWindow(s.id, credit)
+	}
+
+	return nil
+}
+
+func (s *muxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.writeClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return s.mux.writeFrame(frameFin, s.id, nil)
+}
+
+// receive buffers the payload of a data frame. It's called from the read
+// loop, so it never waits on the connection's write side.
+func (s *muxStream) receive(payload []byte) error {
+	length := uint32(len(payload))
+
+	s.mu.Lock()
+	if length > s.recvWindow {
+		s.mu.Unlock()
+		return fmt.Errorf("stream %d exceeded its receive window: %d > %d", s.id, length, s.recvWindow)
+	}
+
+	if !s.readClosed {
+		s.recvWindow -= length
+		s.recvBuf.Write(payload)
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	if length > 0 {
+		go s.mux.writeWindow(s.id, length)
+	}
+
+	return nil
+}
+
+func (s *muxStream) receiveFIN() {
+	s.mu.Lock()
+	s.finRecv = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *muxStream) addSendWindow(credit uint32) {
+	s.mu.Lock()
+	s.sendWindow += credit
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *muxStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
@@ -0,0 +1,346 @@
+package wsnet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"proxy-bench/logx"
+	"proxy-bench/netx"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var logger = logx.New("wsnet")
+
+// muxQuery is the query parameter a client sets on the address to multiplex
+// all of its streams over a single WebSocket connection, e.g.
+// ws://127.0.0.1:2443/?mux=1. Without it every stream gets its own
+// connection.
+const muxQuery = "mux"
+
+const (
+	bufferSize   = 32 * 1024
+	controlWait  = 5 * time.Second
+	closeMessage = "end of stream"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  bufferSize,
+	WriteBufferSize: bufferSize,
+}
+
+type ServerSession struct {
+	listener   net.Listener
+	tlsConfig  *tls.Config
+	keepAlive  netx.KeepAlive
+	mu         sync.Mutex
+	incoming   chan netx.Stream
+	closedCh   chan struct{}
+	httpServer *http.Server
+}
+
+// NewServerSession serves WebSocket connections on listener, the multiplexed
+// ones are pinged as set by keepAlive.
+func NewServerSession(listener net.Listener, tlsConfig *tls.Config, keepAlive netx.KeepAlive) *ServerSession {
+	return &ServerSession{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		keepAlive: keepAlive,
+		incoming:  make(chan netx.Stream),
+		closedCh:  make(chan struct{}),
+	}
+}
+
+func (s *ServerSession) bootstrap() (<-chan netx.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.httpServer != nil {
+		return s.incoming, nil
+	}
+
+	listener := s.listener
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, http1TLSConfig(s.tlsConfig))
+	}
+
+	server := &http.Server{
+		Handler: s,
+		// WebSocket upgrades only work over HTTP/1.1.
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warn().Err(err).Msg("WebSocket server stopped")
+		}
+	}()
+
+	s.httpServer = server
+	return s.incoming, nil
+}
+
+func (s *ServerSession) AcceptStream() (netx.Stream, error) {
+	incoming, err := s.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-s.closedCh:
+		return nil, os.ErrClosed
+	case stream := <-incoming:
+		return stream, nil
+	}
+}
+
+// ServeHTTP called by client
+func (s *ServerSession) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("Failed to upgrade WebSocket")
+		return
+	}
+
+	logger.Debug().Str("remote", r.RemoteAddr).Msg("Accepted WebSocket connection")
+
+	if mux, _ := strconv.ParseBool(r.URL.Query().Get(muxQuery)); mux {
+		m := newMuxConn(conn, s.keepAlive, s.offer)
+		err := m.run()
+		if err != nil {
+			logger.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("WebSocket mux connection closed")
+		}
+		return
+	}
+
+	s.offer(newWsStream(conn))
+}
+
+func (s *ServerSession) offer(stream netx.Stream) {
+	select {
+	case s.incoming <- stream:
+	case <-s.closedCh:
+		stream.Close()
+	}
+}
+
+func (s *ServerSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.httpServer == nil {
+		return nil
+	}
+
+	err := s.httpServer.Close()
+	s.httpServer = nil
+	close(s.closedCh)
+	return err
+}
+
+type ClientSession struct {
+	url       string
+	mux       bool
+	keepAlive netx.KeepAlive
+	dialer    *websocket.Dialer
+	mu        sync.Mutex
+	muxConn   *muxConn
+}
+
+// NewClientSession creates a session to rawURL. Connections are opened by dial,
+// TLS is done by the WebSocket dialer for wss URLs. A multiplexed connection
+// is pinged as set by keepAlive.
+func NewClientSession(rawURL string, dial netx.Dialer, tlsConfig *tls.Config, keepAlive netx.KeepAlive) (*ClientSession, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	mux, _ := strconv.ParseBool(u.Query().Get(muxQuery))
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+		ReadBufferSize:  bufferSize,
+		WriteBufferSize: bufferSize,
+	}
+	if tlsConfig != nil {
+		dialer.TLSClientConfig = http1TLSConfig(tlsConfig)
+	}
+
+	return &ClientSession{
+		url:       rawURL,
+		mux:       mux,
+		keepAlive: keepAlive,
+		dialer:    dialer,
+	}, nil
+}
+
+func (s *ClientSession) dial() (*websocket.Conn, error) {
+	conn, _, err := s.dialer.Dial(s.url, nil)
+	return conn, err
+}
+
+func (s *ClientSession) bootstrap() (*muxConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.muxConn != nil && !s.muxConn.isClosed() {
+		return s.muxConn, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMuxConn(conn, s.keepAlive, func(stream netx.Stream) {
+		// Only the client opens streams.
+		stream.Close()
+	})
+	go func() {
+		err := m.run()
+		if err != nil {
+			logger.Debug().Err(err).Str("url", s.url).Msg("WebSocket mux connection closed")
+		}
+	}()
+
+	s.muxConn = m
+	return m, nil
+}
+
+func (s *ClientSession) OpenStream() (netx.Stream, error) {
+	if !s.mux {
+		conn, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+
+		return newWsStream(conn), nil
+	}
+
+	m, err := s.bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.openStream()
+}
+
+func (s *ClientSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.muxConn != nil {
+		err := s.muxConn.conn.Close()
+		s.muxConn = nil
+		return err
+	}
+
+	return nil
+}
+
+// wsStream is a stream owning a whole WebSocket connection. Each Write is
+// sent as one binary message and CloseWrite sends the close frame, which the
+// peer reads as EOF while still being allowed to send.
+type wsStream struct {
+	conn        *websocket.Conn
+	reader      io.Reader
+	writeClosed atomic.Bool
+}
+
+func newWsStream(conn *websocket.Conn) *wsStream {
+	// The default handler answers a close frame right away, which would
+	// prevent the peer from finishing its half of the stream.
+	conn.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
+
+	return &wsStream{
+		conn: conn,
+	}
+}
+
+func (s *wsStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *wsStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *wsStream) Read(p []byte) (n int, err error) {
+	for {
+		if s.reader == nil {
+			messageType, reader, err := s.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+
+			s.reader = reader
+		}
+
+		n, err = s.reader.Read(p)
+		if err == io.EOF {
+			s.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(p []byte) (n int, err error) {
+	if s.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+
+	err = s.conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return errors.Join(s.CloseWrite(), s.conn.Close())
+}
+
+func (s *wsStream) CloseRead() error {
+	return nil
+}
+
+func (s *wsStream) CloseWrite() error {
+	if s.writeClosed.CompareAndSwap(false, true) {
+		return s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, closeMessage),
+			time.Now().Add(controlWait))
+	}
+
+	return nil
+}
+
+// http1TLSConfig returns a copy of tlsConfig which only negotiates HTTP/1.1,
+// since the shared configs advertise h2 for gRPC.
+func http1TLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	return tlsConfig
+}